@@ -17,8 +17,11 @@
 package config
 
 import (
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/deepflowio/deepflow/server/ingester/common"
@@ -33,6 +36,10 @@ var log = logging.MustGetLogger("config")
 const (
 	DefaultESHostPort      = "elasticsearch:20042"
 	DefaultSyslogDirectory = "/var/log/deepflow-agent"
+
+	// same as the limits in package pcap
+	MaxPCapCreateRetries        = 5
+	MaxPCapCreateRetryBackoffMs = 1000
 )
 
 type ESAuth struct {
@@ -76,15 +83,63 @@ type QueueConfig struct {
 	CompressedQueueSize int `yaml:"compressed-queue-size"`
 }
 
+// PCapOutputFormat is an extra copy of each capture with a different snaplen
+type PCapOutputFormat struct {
+	Name    string `yaml:"name"`
+	Snaplen int    `yaml:"snaplen"`
+}
+
 type PCapConfig struct {
-	TCPIPChecksum         bool   `yaml:"tcpip-checksum"`
-	BlockSizeKB           int    `yaml:"block-size-kb"`
-	MaxConcurrentFiles    int    `yaml:"max-concurrent-files"`
-	MaxFileSizeMB         int    `yaml:"max-file-size-mb"`
-	MaxFilePeriodSecond   int    `yaml:"max-file-period-second"`
-	MaxDirectorySizeGB    int    `yaml:"max-directory-size-gb"`
-	DiskFreeSpaceMarginGB int    `yaml:"disk-free-space-margin-gb"`
-	FileDirectory         string `yaml:"file-directory"`
+	TCPIPChecksum         bool               `yaml:"tcpip-checksum"`
+	BlockSizeKB           int                `yaml:"block-size-kb"`
+	MaxConcurrentFiles    int                `yaml:"max-concurrent-files"`
+	MaxFileSizeMB         int                `yaml:"max-file-size-mb"`
+	MaxFilePeriodSecond   int                `yaml:"max-file-period-second"`
+	MaxDirectorySizeGB    int                `yaml:"max-directory-size-gb"`
+	DiskFreeSpaceMarginGB int                `yaml:"disk-free-space-margin-gb"`
+	FileDirectory         string             `yaml:"file-directory"`
+	SyncOnClose           bool               `yaml:"sync-on-close"`
+	MaxPacketsPerFile     int                `yaml:"max-packets-per-file"`
+	FileNodeID            string             `yaml:"file-node-id"`
+	IdleTimeoutSecond     int                `yaml:"idle-timeout-second"`
+	WriterKeyMode         string             `yaml:"writer-key-mode"`     // tap-port, flow or policy
+	RotationClock         string             `yaml:"rotation-clock"`      // wall or packet
+	EncryptionKeyFile     string             `yaml:"encryption-key-file"` // hex encoded AES-128/192/256 key
+	EncryptionKey         []byte             `yaml:"-"`
+	DryRun                bool               `yaml:"dry-run"`
+	MaxPacketSize         int                `yaml:"max-packet-size"` // 0 means 65535
+	DropOversizedPackets  bool               `yaml:"drop-oversized-packets"`
+	StructuredLog         bool               `yaml:"structured-log"`
+	RecoverTempFiles      bool               `yaml:"recover-temp-files"`
+	FileCreationRate      int                `yaml:"file-creation-rate"` // per second, 0 means unlimited
+	FileCreationBurst     int                `yaml:"file-creation-burst"`
+	MaxFilesPerAclGID     int                `yaml:"max-files-per-acl-gid"`   // per worker, 0 means unlimited
+	OverflowCapacity      int                `yaml:"overflow-capacity"`       // packets held per worker beyond max-concurrent-files, 0 means disabled
+	SlowWriteThresholdMs  int                `yaml:"slow-write-threshold-ms"` // 0 means disabled
+	DropOnSlowWrite       bool               `yaml:"drop-on-slow-write"`
+	TapTypeDirectory      bool               `yaml:"tap-type-directory"`
+	TapTypeNames          map[uint8]string   `yaml:"tap-type-names"` // names in filenames instead of tor/ispN, e.g. {3: cloud}
+	QueueBatchSize        int                `yaml:"queue-batch-size"`
+	CloseTimeoutSecond    int                `yaml:"close-timeout-second"`    // 0 means waiting forever
+	QuarantineFailedFiles bool               `yaml:"quarantine-failed-files"` // keep temp files failed to write instead of finishing them
+	MonotonicTimestamp    bool               `yaml:"monotonic-timestamp"`
+	ExtraOutputFormats    []PCapOutputFormat `yaml:"extra-output-formats"`
+	DecapsulateTunnel     bool               `yaml:"decapsulate-tunnel"`      // write inner frames of VXLAN/GRE/IPIP packets
+	PacketsWithFCS        bool               `yaml:"packets-with-fcs"`        // frames include the Ethernet FCS, strip it before writing
+	CreateRetries         int                `yaml:"create-retries"`          // consecutive creation failures backed off, at most 5, 0 means no backoff
+	CreateRetryBackoffMs  int                `yaml:"create-retry-backoff-ms"` // no file is created within it after a failure, 10ms by default, at most 1000
+	MinPacketSize         int                `yaml:"min-packet-size"`         // shorter packets are skipped, 0 means disabled, 14 skips frames without an Ethernet header
+	RouteByWriterKey      bool               `yaml:"route-by-writer-key"`     // one worker per writer key, may unbalance workers
+	MinFreeDiskSpaceMB    int                `yaml:"min-free-disk-space-mb"`  // stop creating files below it, 0 means disabled
+	FailoverDirectory     string             `yaml:"file-failover-directory"` // new files go here when file-directory is below min-free-disk-space-mb
+	MinBlockSizeKB        int                `yaml:"min-block-size-kb"`       // lower bound of the adaptive buffer size
+	MaxBlockSizeKB        int                `yaml:"max-block-size-kb"`       // buffer size adapts to throughput if larger than min
+	FlowByteBudgetKB      int                `yaml:"flow-byte-budget-kb"`     // bytes kept of each file until rotation, 0 means unlimited
+	RingFiles             int                `yaml:"ring-files"`              // finished files kept per writer key, 0 means unlimited
+	FlowSummary           bool               `yaml:"flow-summary"`            // write <file>.json summaries of finalized files
+	IdleBackoffTicks      int                `yaml:"idle-backoff-ticks"`      // empty ticks before sweeping less often, 0 means disabled
+	IdleBackoffMinMs      int                `yaml:"idle-backoff-min-ms"`     // 20s by default
+	IdleBackoffMaxMs      int                `yaml:"idle-backoff-max-ms"`     // 60s by default, bounds the delay of finishing files
 }
 
 func minPowerOfTwo(v int) int {
@@ -150,9 +205,63 @@ func (c *Config) Validate() error {
 	if c.PCap.DiskFreeSpaceMarginGB <= 0 {
 		c.PCap.DiskFreeSpaceMarginGB = 10
 	}
+	if c.PCap.MaxPacketsPerFile < 0 {
+		c.PCap.MaxPacketsPerFile = 0
+	}
+	if c.PCap.FileCreationRate < 0 {
+		c.PCap.FileCreationRate = 0
+	}
+	if c.PCap.MaxPacketSize < 0 {
+		c.PCap.MaxPacketSize = 0
+	}
+	if c.PCap.QueueBatchSize <= 0 {
+		c.PCap.QueueBatchSize = 1024
+	}
+	if c.PCap.IdleTimeoutSecond < 0 || c.PCap.IdleTimeoutSecond >= c.PCap.MaxFilePeriodSecond {
+		c.PCap.IdleTimeoutSecond = 0
+	}
+	if c.PCap.WriterKeyMode != "tap-port" && c.PCap.WriterKeyMode != "flow" && c.PCap.WriterKeyMode != "policy" {
+		if c.PCap.WriterKeyMode != "" {
+			log.Warningf("invalid pcap writer-key-mode %s, use tap-port instead", c.PCap.WriterKeyMode)
+		}
+		c.PCap.WriterKeyMode = "tap-port"
+	}
+	if c.PCap.RotationClock != "wall" && c.PCap.RotationClock != "packet" {
+		if c.PCap.RotationClock != "" {
+			log.Warningf("invalid pcap rotation-clock %s, use wall instead", c.PCap.RotationClock)
+		}
+		c.PCap.RotationClock = "wall"
+	}
 	if c.PCap.FileDirectory == "" {
 		c.PCap.FileDirectory = common.DEFAULT_PCAP_DATA_PATH
 	}
+	// 创建文件时持有锁，退避的次数和间隔都需要限制
+	if c.PCap.CreateRetries < 0 {
+		c.PCap.CreateRetries = 0
+	} else if c.PCap.CreateRetries > MaxPCapCreateRetries {
+		log.Warningf("pcap create-retries %d exceeds the limit, use %d instead", c.PCap.CreateRetries, MaxPCapCreateRetries)
+		c.PCap.CreateRetries = MaxPCapCreateRetries
+	}
+	if c.PCap.CreateRetryBackoffMs < 0 {
+		c.PCap.CreateRetryBackoffMs = 0
+	} else if c.PCap.CreateRetryBackoffMs > MaxPCapCreateRetryBackoffMs {
+		log.Warningf("pcap create-retry-backoff-ms %d exceeds the limit, use %d instead", c.PCap.CreateRetryBackoffMs, MaxPCapCreateRetryBackoffMs)
+		c.PCap.CreateRetryBackoffMs = MaxPCapCreateRetryBackoffMs
+	}
+	if c.PCap.EncryptionKeyFile != "" {
+		content, err := ioutil.ReadFile(c.PCap.EncryptionKeyFile)
+		if err != nil {
+			return fmt.Errorf("read pcap encryption-key-file failed: %s", err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil {
+			return fmt.Errorf("decode pcap encryption-key-file failed: %s", err)
+		}
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return fmt.Errorf("invalid pcap encryption key length %d, should be 16, 24 or 32 bytes", len(key))
+		}
+		c.PCap.EncryptionKey = key
+	}
 
 	if c.SyslogDirectory == "" {
 		c.SyslogDirectory = DefaultSyslogDirectory
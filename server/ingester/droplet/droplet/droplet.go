@@ -28,6 +28,7 @@ import (
 	libpcap "github.com/deepflowio/deepflow/server/libs/pcap"
 	libqueue "github.com/deepflowio/deepflow/server/libs/queue"
 	"github.com/deepflowio/deepflow/server/libs/receiver"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
 
 	"github.com/deepflowio/deepflow/message/trident"
 	"github.com/deepflowio/deepflow/server/ingester/droplet/adapter"
@@ -54,6 +55,7 @@ func Start(cfg *config.Config, recv *receiver.Receiver) (closers []io.Closer) {
 	}
 
 	cleaner := libpcap.NewCleaner(5*time.Minute, int64(cfg.PCap.MaxDirectorySizeGB)<<30, int64(cfg.PCap.DiskFreeSpaceMarginGB)<<30, cfg.PCap.FileDirectory)
+	cleaner.AddDirectory(cfg.PCap.FailoverDirectory)
 	cleaner.Start()
 
 	// L1 - packet source from tridentAdapter
@@ -107,6 +109,61 @@ func Start(cfg *config.Config, recv *receiver.Receiver) (closers []io.Closer) {
 		synchronizer.Start()
 	}
 
+	var extraOutputFormats pcap.OptionExtraOutputFormats
+	for _, format := range cfg.PCap.ExtraOutputFormats {
+		extraOutputFormats = append(extraOutputFormats, pcap.OutputFormat{Name: format.Name, Snaplen: format.Snaplen})
+	}
+	tapTypeNames := make(pcap.OptionTapTypeNames, len(cfg.PCap.TapTypeNames))
+	for tapType, name := range cfg.PCap.TapTypeNames {
+		tapTypeNames[zerodoc.TAPTypeEnum(tapType)] = name
+	}
+	pcapOptions := []pcap.Option{
+		pcap.OptionSyncOnClose(cfg.PCap.SyncOnClose),
+		pcap.OptionMaxPacketsPerFile(cfg.PCap.MaxPacketsPerFile),
+		pcap.OptionFlowByteBudgetKB(cfg.PCap.FlowByteBudgetKB),
+		pcap.OptionRingFiles(cfg.PCap.RingFiles),
+		pcap.OptionFlowSummary(cfg.PCap.FlowSummary),
+		pcap.OptionIdleBackoffTicks(cfg.PCap.IdleBackoffTicks),
+		pcap.OptionIdleBackoffMinMs(cfg.PCap.IdleBackoffMinMs),
+		pcap.OptionIdleBackoffMaxMs(cfg.PCap.IdleBackoffMaxMs),
+		pcap.OptionNodeID(cfg.PCap.FileNodeID),
+		pcap.OptionIdleTimeoutSecond(cfg.PCap.IdleTimeoutSecond),
+		pcap.OptionWriterKeyMode(pcap.StringToWriterKeyMode(cfg.PCap.WriterKeyMode)),
+		pcap.OptionRotationClock(pcap.StringToRotationClock(cfg.PCap.RotationClock)),
+		pcap.OptionDryRun(cfg.PCap.DryRun),
+		pcap.OptionMaxPacketSize(cfg.PCap.MaxPacketSize),
+		pcap.OptionMinPacketSize(cfg.PCap.MinPacketSize),
+		pcap.OptionDropOversizedPackets(cfg.PCap.DropOversizedPackets),
+		pcap.OptionStructuredLog(cfg.PCap.StructuredLog),
+		pcap.OptionRecoverTempFiles(cfg.PCap.RecoverTempFiles),
+		pcap.OptionFileCreationRate(cfg.PCap.FileCreationRate),
+		pcap.OptionFileCreationBurst(cfg.PCap.FileCreationBurst),
+		pcap.OptionMaxFilesPerAclGID(cfg.PCap.MaxFilesPerAclGID),
+		pcap.OptionOverflowCapacity(cfg.PCap.OverflowCapacity),
+		pcap.OptionSlowWriteThresholdMs(cfg.PCap.SlowWriteThresholdMs),
+		pcap.OptionDropOnSlowWrite(cfg.PCap.DropOnSlowWrite),
+		pcap.OptionTapTypeDirectory(cfg.PCap.TapTypeDirectory),
+		tapTypeNames,
+		pcap.OptionQueueBatchSize(cfg.PCap.QueueBatchSize),
+		pcap.OptionCloseTimeoutSecond(cfg.PCap.CloseTimeoutSecond),
+		pcap.OptionQuarantineOnWriteFailure(cfg.PCap.QuarantineFailedFiles),
+		pcap.OptionMonotonicTimestamp(cfg.PCap.MonotonicTimestamp),
+		pcap.OptionDecapsulateTunnel(cfg.PCap.DecapsulateTunnel),
+		pcap.OptionPacketsWithFCS(cfg.PCap.PacketsWithFCS),
+		pcap.OptionCreateRetries(cfg.PCap.CreateRetries),
+		pcap.OptionCreateRetryBackoffMs(cfg.PCap.CreateRetryBackoffMs),
+		pcap.OptionRouteByWriterKey(cfg.PCap.RouteByWriterKey),
+		pcap.OptionPacketQueueSize(cfg.Queue.PacketQueueSize),
+		pcap.OptionMinFreeDiskSpaceMB(cfg.PCap.MinFreeDiskSpaceMB),
+		pcap.OptionFailoverDirectory(cfg.PCap.FailoverDirectory),
+		pcap.OptionOnNewDirectory(cleaner.SetBaseDirectory),
+		pcap.OptionMinBlockSizeKB(cfg.PCap.MinBlockSizeKB),
+		pcap.OptionMaxBlockSizeKB(cfg.PCap.MaxBlockSizeKB),
+		extraOutputFormats,
+	}
+	if len(cfg.PCap.EncryptionKey) > 0 {
+		pcapOptions = append(pcapOptions, pcap.OptionEncryptionKey(cfg.PCap.EncryptionKey))
+	}
 	pcapClosers := pcap.NewWorkerManager(
 		pcapAppQueues.Readers(),
 		pcapAppQueues.Writers(),
@@ -118,6 +175,7 @@ func Start(cfg *config.Config, recv *receiver.Receiver) (closers []io.Closer) {
 		cfg.PCap.MaxDirectorySizeGB,
 		cfg.PCap.DiskFreeSpaceMarginGB,
 		cfg.PCap.FileDirectory,
+		pcapOptions...,
 	).Start()
 	closers = append(closers, pcapClosers...)
 	// 其他所有组件启动完成以后运行TridentAdapter，尽量避免启动过程中队列丢包
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"net"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+// CaptureInfo describes a pcap file being written
+type CaptureInfo struct {
+	Worker   int
+	Filename string // temp filename, renamed when the file is finished
+
+	TapType zerodoc.TAPTypeEnum
+	AclGID  uint16
+	VtapId  uint16
+	Mac     string // tap port
+	// endpoints of the flow, only set in WRITER_KEY_BY_FLOW mode
+	IP0, IP1 net.IP
+
+	FirstPacketTime time.Duration
+	LastPacketTime  time.Duration
+	Size            int64 // including the buffered bytes not flushed yet
+	PacketCount     uint64
+}
+
+// ListOpenCaptures returns the files being written by all workers, it's safe
+// to be called concurrently with packet processing
+func (m *WorkerManager) ListOpenCaptures() []CaptureInfo {
+	var captures []CaptureInfo
+	for _, w := range m.workers {
+		if w == nil {
+			continue
+		}
+		captures = w.listOpenCaptures(captures)
+	}
+	return captures
+}
+
+func (w *Worker) listOpenCaptures(captures []CaptureInfo) []CaptureInfo {
+	w.writersLock.Lock()
+	defer w.writersLock.Unlock()
+
+	for _, writers := range w.writers {
+		for _, writer := range writers {
+			capture := CaptureInfo{
+				Worker:          w.index,
+				Filename:        writer.tempFilename,
+				TapType:         writer.tapType,
+				AclGID:          writer.aclGID,
+				VtapId:          writer.vtapId,
+				Mac:             tapPortToMacString(writer.tapPort),
+				FirstPacketTime: writer.firstPacketTime,
+				LastPacketTime:  writer.lastPacketTime,
+				Size:            writer.size,
+				PacketCount:     writer.packetCount,
+			}
+			if w.writerKeyMode == WRITER_KEY_BY_FLOW {
+				capture.IP0, capture.IP1 = writer.flow.ips()
+			}
+			captures = append(captures, capture)
+		}
+	}
+	return captures
+}
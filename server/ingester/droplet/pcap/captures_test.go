@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestListOpenCaptures(t *testing.T) {
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionWriterKeyMode(WRITER_KEY_BY_FLOW))
+	w := m.newWorker(0)
+	m.workers[0] = w
+	packet := newRawPacket(time.Second, 64)
+	packet.EthType = layers.EthernetTypeIPv4
+	packet.IpSrc, packet.IpDst = 0x0a000001, 0x0a000002
+	packet.TapPort = 0x1234
+	w.writePacket(packet, zerodoc.CLOUD, 1)
+	packet.Timestamp = 2 * time.Second
+	w.writePacket(packet, zerodoc.CLOUD, 1)
+
+	captures := m.ListOpenCaptures()
+	if len(captures) != 1 {
+		t.Fatalf("expected 1 capture, got %d", len(captures))
+	}
+	c := captures[0]
+	if c.TapType != zerodoc.CLOUD || c.AclGID != 1 || c.Mac != "000000001234" || c.PacketCount != 2 {
+		t.Errorf("unexpected capture %+v", c)
+	}
+	if c.FirstPacketTime != time.Second || c.LastPacketTime != 2*time.Second {
+		t.Errorf("unexpected packet time %s and %s", c.FirstPacketTime, c.LastPacketTime)
+	}
+	if c.Size != GLOBAL_HEADER_LEN+2*(RECORD_HEADER_LEN+64) {
+		t.Errorf("unexpected size %d", c.Size)
+	}
+	ips := []net.IP{c.IP0, c.IP1}
+	if !ips[0].Equal(net.IPv4(10, 0, 0, 1)) && !ips[1].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("unexpected flow ips %s and %s", c.IP0, c.IP1)
+	}
+}
+
+func TestListOpenCapturesConcurrently(t *testing.T) {
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionDryRun(true))
+	w := m.newWorker(0)
+	m.workers[0] = w
+
+	const blocks = 100
+	go func() {
+		for i := 0; i < blocks; i++ {
+			block := datatype.AcquireMetaPacketBlock()
+			block.Metas[0] = *newPolicyPacket(time.Second, 64, uint32(i%4+1))
+			block.Count = 1
+			w.processBlock(block, nil)
+		}
+	}()
+	// 与Process并发读取，由-race检查
+	for packets := uint64(0); packets < blocks; {
+		packets = 0
+		for _, c := range m.ListOpenCaptures() {
+			packets += c.PacketCount
+		}
+	}
+	if captures := m.ListOpenCaptures(); len(captures) != 4 {
+		t.Errorf("expected 4 captures, got %d", len(captures))
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 包时间与墙上时间相差超过该值时认为时钟漂移
+const CLOCK_DRIFT_THRESHOLD = time.Minute
+
+type RotationClock uint8
+
+const (
+	ROTATION_BY_WALL_CLOCK  RotationClock = iota // 按本机时间结束超时文件
+	ROTATION_BY_PACKET_TIME                      // 按包时间结束超时文件，适用于回放或采集点时钟不准的场景
+)
+
+var rotationClockNames = map[string]RotationClock{
+	"wall":   ROTATION_BY_WALL_CLOCK,
+	"packet": ROTATION_BY_PACKET_TIME,
+}
+
+// StringToRotationClock falls back to ROTATION_BY_WALL_CLOCK for unknown names
+func StringToRotationClock(name string) RotationClock {
+	return rotationClockNames[name]
+}
+
+// tickTime returns the time to check file timeouts against on tick, and counts
+// the drift between packet time and wall clock.
+// Packet time advances with wall clock since the tick the newest packet is
+// seen, so that files can still time out without new packets.
+func (w *Worker) tickTime(now time.Time) time.Duration {
+	wallTime := time.Duration(now.UnixNano())
+	if w.newestPacketTime == 0 {
+		return wallTime
+	}
+	if w.newestPacketTime != w.anchorPacketTime {
+		w.anchorPacketTime = w.newestPacketTime
+		w.anchorWallTime = now
+	}
+	packetTime := w.anchorPacketTime + now.Sub(w.anchorWallTime)
+
+	drift := wallTime - packetTime
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > CLOCK_DRIFT_THRESHOLD {
+		atomic.AddUint64(&w.ClockDriftEvents, 1)
+		if !w.clockDrifting {
+			log.Warningf("pcap worker (%d) packet time %s drifts from wall clock %s", w.index, formatDuration(packetTime), formatDuration(wallTime))
+			w.clockDrifting = true
+		}
+	} else if w.clockDrifting {
+		log.Infof("pcap worker (%d) packet time is in sync with wall clock again", w.index)
+		w.clockDrifting = false
+	}
+
+	if w.rotationClock == ROTATION_BY_PACKET_TIME {
+		return packetTime
+	}
+	return wallTime
+}
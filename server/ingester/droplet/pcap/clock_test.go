@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockDrift(t *testing.T) {
+	w := newTestWorker(t, OptionRotationClock(ROTATION_BY_PACKET_TIME))
+	now := time.Unix(1000000, 0)
+	if tickTime := w.tickTime(now); tickTime != time.Duration(now.UnixNano()) {
+		t.Errorf("wall clock should be used before any packet, got %s", tickTime)
+	}
+
+	// 回放一小时前的包
+	packetTime := time.Duration(now.UnixNano()) - time.Hour
+	w.processPacket(newPolicyPacket(packetTime, 64, 1))
+	if tickTime := w.tickTime(now); tickTime != packetTime || w.ClockDriftEvents != 1 || !w.clockDrifting {
+		t.Errorf("expected packet time with drift detected, got %s and %d events", tickTime, w.ClockDriftEvents)
+	}
+	// 没有新包时按墙上时间推进，使文件仍然可以超时结束
+	now = now.Add(w.maxFilePeriod + time.Second)
+	if tickTime := w.tickTime(now); tickTime != packetTime+w.maxFilePeriod+time.Second {
+		t.Errorf("packet time should advance with wall clock, got %s", tickTime)
+	}
+	w.cleanTimeoutFile(w.tickTime(now))
+	if w.WriterCount() != 0 {
+		t.Error("file should time out by packet time")
+	}
+
+	w.processPacket(newPolicyPacket(time.Duration(now.UnixNano()), 64, 1))
+	if w.tickTime(now); w.ClockDriftEvents != 3 || w.clockDrifting {
+		t.Errorf("drift should be recovered, got %d events", w.ClockDriftEvents)
+	}
+}
+
+func TestRotationByWallClock(t *testing.T) {
+	w := newTestWorker(t)
+	now := time.Unix(1000000, 0)
+	w.processPacket(newPolicyPacket(time.Duration(now.UnixNano())-time.Hour, 64, 1))
+	if tickTime := w.tickTime(now); tickTime != time.Duration(now.UnixNano()) || w.ClockDriftEvents != 1 {
+		t.Errorf("expected wall clock with drift detected, got %s and %d events", tickTime, w.ClockDriftEvents)
+	}
+}
@@ -16,6 +16,36 @@
 
 package pcap
 
+import "time"
+
 const (
 	TIME_FORMAT = "060102150405"
+	TEMP_SUFFIX = ".temp"
+
+	QUARANTINE_SUFFIX = ".failed" // appended to TEMP_SUFFIX, cleaned like finished files by libs/pcap.Cleaner
+	SUMMARY_SUFFIX    = ".json"   // removed together with the pcap file by libs/pcap.Cleaner
+
+	SLOW_WRITE_BACKOFF = time.Second
+
+	INVALID_PACKET_LOG_INTERVAL = time.Minute
+
+	// 创建失败后暂停创建文件，期间需要新文件的包被丢弃，次数和间隔都不宜过大
+	MAX_CREATE_RETRIES          = 5
+	CREATE_RETRY_BACKOFF        = 10 * time.Millisecond // doubled after each consecutive failure
+	MAX_CREATE_RETRY_BACKOFF_MS = 1000
+
+	MIN_PACKET_SIZE = 0 // no packet is skipped by size by default
+
+	DISK_SPACE_CHECK_INTERVAL = time.Second // free disk space is cached for this long
+
+	// 自适应缓冲区大小按近期写入速率调整，使每个文件约每秒刷盘一次
+	BUFFER_SIZE_ADJUST_INTERVAL = 10 * time.Second
+
+	// 空闲时过期检查的间隔上限，也是maxFilePeriod到期后文件最多延迟关闭的时间
+	IDLE_BACKOFF_MIN = 20 * time.Second
+	IDLE_BACKOFF_MAX = time.Minute
+
+	RING_IDLE_PERIODS = 2 // rings of writer keys idle for this many file periods are forgotten
+
+	FINISHER_QUEUE_SIZE = 1024 // closed files waiting for encryption or sync in each worker
 )
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+const VLAN_HEADER_SIZE = 4
+
+var DECAPSULATE_TUNNEL_TYPES = datatype.NewTunnelTypeBitmap(
+	datatype.TUNNEL_TYPE_VXLAN,
+	datatype.TUNNEL_TYPE_IPIP,
+	datatype.TUNNEL_TYPE_TENCENT_GRE,
+	datatype.TUNNEL_TYPE_ERSPAN_OR_TEB,
+)
+
+// ethernetL3 returns the L2 header length and whether L3 is IPv6, ok is false
+// if frame is neither IPv4 nor IPv6 over Ethernet with at most one VLAN tag
+func ethernetL3(frame []byte) (l2Len int, ipv6 bool, ok bool) {
+	l2Len = datatype.ETH_HEADER_SIZE
+	if len(frame) < l2Len {
+		return 0, false, false
+	}
+	ethType := layers.EthernetType(binary.BigEndian.Uint16(frame[l2Len-datatype.ETH_TYPE_LEN:]))
+	if ethType == layers.EthernetTypeDot1Q {
+		l2Len += VLAN_HEADER_SIZE
+		if len(frame) < l2Len {
+			return 0, false, false
+		}
+		ethType = layers.EthernetType(binary.BigEndian.Uint16(frame[l2Len-datatype.ETH_TYPE_LEN:]))
+	}
+	switch ethType {
+	case layers.EthernetTypeIPv4:
+		return l2Len, false, true
+	case layers.EthernetTypeIPv6:
+		return l2Len, true, true
+	}
+	return 0, false, false
+}
+
+// decapsulate returns a copy of packet whose RawHeader starts at the innermost
+// Ethernet header, or nil if packet is not tunneled or its RawHeader doesn't
+// contain the tunnel headers, e.g. it's decapsulated by the agent already.
+// The returned packet is valid until the next call.
+func (w *Worker) decapsulate(packet *datatype.MetaPacket) *datatype.MetaPacket {
+	if packet.Tunnel == nil || !packet.Tunnel.Valid() || packet.RawHeaderSize == 0 {
+		return nil
+	}
+	// TunnelInfo的解封装会改写内层L2头，不能修改原始数据
+	w.decapsulateBuffer = append(w.decapsulateBuffer[:0], packet.RawHeader[:packet.RawHeaderSize]...)
+	frame := w.decapsulateBuffer
+	tunnel := datatype.TunnelInfo{}
+	for {
+		l2Len, ipv6, ok := ethernetL3(frame)
+		if !ok {
+			break
+		}
+		var offset int
+		if ipv6 {
+			offset = tunnel.Decapsulate6(frame, l2Len, DECAPSULATE_TUNNEL_TYPES)
+		} else {
+			offset = tunnel.Decapsulate(frame, l2Len, DECAPSULATE_TUNNEL_TYPES)
+		}
+		if offset == 0 {
+			break
+		}
+		frame = frame[l2Len+offset:]
+	}
+	stripped := len(w.decapsulateBuffer) - len(frame)
+	if stripped == 0 {
+		return nil
+	}
+
+	w.decapsulatedPacket = *packet
+	w.decapsulatedPacket.RawHeader = frame
+	w.decapsulatedPacket.RawHeaderSize = uint16(len(frame))
+	if int(packet.PacketLen) > stripped {
+		w.decapsulatedPacket.PacketLen = packet.PacketLen - uint16(stripped)
+	} else {
+		w.decapsulatedPacket.PacketLen = uint16(len(frame))
+	}
+	atomic.AddUint64(&w.DecapsulatedPackets, 1)
+	return &w.decapsulatedPacket
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func serializeLayers(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, l...); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buffer.Bytes()...)
+}
+
+// newVxlanPacket returns a VXLAN packet and its inner frame
+func newVxlanPacket(t *testing.T, timestamp time.Duration) (*datatype.MetaPacket, []byte) {
+	inner := serializeLayers(t,
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 3}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 4}, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{192, 168, 0, 1}, DstIP: net.IP{192, 168, 0, 2}},
+		gopacket.Payload(make([]byte, 40)),
+	)
+	udp := &layers.UDP{SrcPort: 12345, DstPort: 4789}
+	outerIP := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	udp.SetNetworkLayerForChecksum(outerIP)
+	raw := serializeLayers(t,
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+		outerIP,
+		udp,
+		&layers.VXLAN{ValidIDFlag: true, VNI: 100},
+		gopacket.Payload(inner),
+	)
+	return &datatype.MetaPacket{
+		RawHeader:     raw,
+		RawHeaderSize: uint16(len(raw)),
+		PacketLen:     uint16(len(raw)),
+		Timestamp:     timestamp,
+		Tunnel:        &datatype.TunnelInfo{Type: datatype.TUNNEL_TYPE_VXLAN, Id: 100},
+	}, inner
+}
+
+func TestDecapsulateTunnel(t *testing.T) {
+	w := newTestWorker(t, OptionDecapsulateTunnel(true))
+	packet, inner := newVxlanPacket(t, time.Second)
+	raw := append([]byte(nil), packet.RawHeader...)
+	w.writePacket(packet, zerodoc.CLOUD, 1)
+	if !bytes.Equal(packet.RawHeader, raw) {
+		t.Error("RawHeader of the original packet should not be modified")
+	}
+	// 没有隧道信息的包原样写入
+	packet.Tunnel = nil
+	w.writePacket(packet, zerodoc.CLOUD, 2)
+	if w.DecapsulatedPackets != 1 {
+		t.Errorf("expected 1 decapsulated packet, got %d", w.DecapsulatedPackets)
+	}
+	w.cleanTimeoutFile(time.Hour)
+
+	for aclGID, expected := range map[string][]byte{"1": inner, "2": raw} {
+		files, _ := filepath.Glob(filepath.Join(w.baseDirectory, aclGID, "*.pcap"))
+		if len(files) != 1 {
+			t.Fatalf("expected 1 file of aclGID %s, got %v", aclGID, files)
+		}
+		records, err := readAll(t, files[0])
+		if err != nil || len(records) != 1 {
+			t.Fatalf("expected 1 record in %s, got %d: %v", files[0], len(records), err)
+		}
+		if !bytes.Equal(records[0].Data, expected) || records[0].OrigLen != len(expected) {
+			t.Errorf("unexpected record of aclGID %s: %d bytes, orig_len %d", aclGID, len(records[0].Data), records[0].OrigLen)
+		}
+	}
+}
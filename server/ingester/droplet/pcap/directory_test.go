@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestSetBaseDirectory(t *testing.T) {
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir())
+	w := m.newWorker(0)
+	former := m.BaseDirectory()
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+
+	failover := filepath.Join(t.TempDir(), "failover")
+	if err := m.SetBaseDirectory(failover); err != nil {
+		t.Fatal(err)
+	}
+	// 已打开的文件仍写到原目录，新文件写到新目录
+	w.writePacket(newRawPacket(2*time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(2*time.Second, 64), zerodoc.CLOUD, 2)
+	if w.BaseDirectoryChanges != 1 {
+		t.Errorf("expected 1 base directory change, got %d", w.BaseDirectoryChanges)
+	}
+	w.cleanTimeoutFile(time.Hour)
+
+	for _, c := range []struct {
+		base  string
+		files int
+	}{{filepath.Join(former, "1"), 1}, {filepath.Join(former, "2"), 0}, {filepath.Join(failover, "2"), 1}} {
+		if files, _ := filepath.Glob(filepath.Join(c.base, "*.pcap")); len(files) != c.files {
+			t.Errorf("expected %d files in %s, got %v", c.files, c.base, files)
+		}
+	}
+}
+
+func TestFailoverOnLowDiskSpace(t *testing.T) {
+	failover := filepath.Join(t.TempDir(), "failover")
+	diskFreeSpace = func(path string) (int64, error) {
+		if path == failover {
+			return 200 << 20, nil
+		}
+		return 50 << 20, nil
+	}
+	defer func() { diskFreeSpace = statfsFreeSpace }()
+
+	var newDirectories []string
+	w := newTestWorker(t, OptionMinFreeDiskSpaceMB(100), OptionFailoverDirectory(failover),
+		OptionOnNewDirectory(func(directory string) { newDirectories = append(newDirectories, directory) }))
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.LowDiskRejections != 0 || w.BaseDirectoryChanges != 1 {
+		t.Fatalf("expected to fail over without rejection, got %d rejections and %d changes", w.LowDiskRejections, w.BaseDirectoryChanges)
+	}
+	if len(newDirectories) != 1 || newDirectories[0] != failover {
+		t.Errorf("failover directory is not reported, got %v", newDirectories)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if files, _ := filepath.Glob(filepath.Join(failover, "1", "*.pcap")); len(files) != 1 {
+		t.Errorf("expected 1 file in the failover directory, got %v", files)
+	}
+}
+
+func TestFinishTempFilesInFailoverDirectory(t *testing.T) {
+	failover := filepath.Join(t.TempDir(), "failover")
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionFailoverDirectory(failover))
+	m.SetBaseDirectory(failover)
+	w := m.newWorker(0)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	crash(w)
+
+	// 重启后基础目录恢复为配置值，故障转移目录中遗留的临时文件也要处理
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	markAndCleanTempFiles(m.directories(), nil, false, false, nil, wg)
+	if files, _ := filepath.Glob(filepath.Join(failover, "1", "*.pcap")); len(files) != 1 {
+		t.Errorf("temp file in the failover directory is not finished, got %v", files)
+	}
+}
+
+func TestLowDiskSpace(t *testing.T) {
+	free := int64(200 << 20)
+	diskFreeSpace = func(string) (int64, error) { return free, nil }
+	defer func() { diskFreeSpace = statfsFreeSpace }()
+
+	w := newTestWorker(t, OptionMinFreeDiskSpaceMB(100))
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	free = 50 << 20
+	// 结果在检查间隔内被缓存
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 2)
+	if w.LowDiskRejections != 0 {
+		t.Errorf("free space should be cached, got %d rejections", w.LowDiskRejections)
+	}
+	w.diskSpaceCheckTime = time.Time{}
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 3)
+	if w.LowDiskRejections != 1 || w.WriterCount() != 2 {
+		t.Errorf("expected 1 rejection and 2 files, got %d and %d", w.LowDiskRejections, w.WriterCount())
+	}
+	w.cleanTimeoutFile(time.Hour)
+	// 已打开的文件继续写入
+	for _, c := range []struct {
+		aclGID         string
+		files, packets int
+	}{{"1", 1, 2}, {"2", 1, 1}, {"3", 0, 0}} {
+		if files, packets := countPackets(t, filepath.Join(w.baseDirectory, c.aclGID, "*.pcap")); files != c.files || packets != c.packets {
+			t.Errorf("expected %d packets in %d files of aclGID %s, got %d in %d", c.packets, c.files, c.aclGID, packets, files)
+		}
+	}
+}
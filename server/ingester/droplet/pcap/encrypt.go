@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	ENCRYPTED_SUFFIX = ".enc"
+	// the encrypted file is written with ENCRYPTING_SUFFIX and renamed when finished,
+	// so that an interrupted encryption never looks like a valid file
+	ENCRYPTING_SUFFIX = ".part"
+
+	// encrypted file layout: magic(8B) | nonce(12B) | chunks, each chunk is
+	// length(4B) | AES-GCM sealed plaintext of at most ENCRYPTED_CHUNK_SIZE,
+	// sealed with the file nonce XOR the chunk index. The highest bit of length
+	// marks the last chunk and is authenticated, so truncation is detected.
+	ENCRYPTED_MAGIC            = "DFPCAPE2"
+	ENCRYPTED_NONCE_LEN        = 12
+	ENCRYPTED_HEADER_LEN       = len(ENCRYPTED_MAGIC) + ENCRYPTED_NONCE_LEN
+	ENCRYPTED_CHUNK_SIZE       = 64 << 10
+	ENCRYPTED_CHUNK_HEADER_LEN = 4
+	ENCRYPTED_LAST_CHUNK       = 1 << 31
+)
+
+var encryptedChunkAdditionalData = [2][]byte{
+	[]byte(ENCRYPTED_MAGIC + "\x00"),
+	[]byte(ENCRYPTED_MAGIC + "\x01"),
+}
+
+func newEncryptionCipher(getKey func() ([]byte, error)) (cipher.AEAD, error) {
+	key, err := getKey()
+	if err != nil {
+		return nil, fmt.Errorf("get encryption key failed: %s", err)
+	}
+	if len(key) == 0 {
+		return nil, errors.New("encryption key is empty")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptedChunks(size int64) int64 {
+	if size == 0 {
+		// 空文件也写一个最后块，以便检测截断
+		return 1
+	}
+	return (size + ENCRYPTED_CHUNK_SIZE - 1) / ENCRYPTED_CHUNK_SIZE
+}
+
+// encryptedSize returns the size of the encrypted file of a plaintext of size bytes
+func encryptedSize(aead cipher.AEAD, size int64) int64 {
+	return int64(ENCRYPTED_HEADER_LEN) + encryptedChunks(size)*int64(ENCRYPTED_CHUNK_HEADER_LEN+aead.Overhead()) + size
+}
+
+func chunkNonce(nonce, fileNonce []byte, index int64) {
+	copy(nonce, fileNonce)
+	offset := len(nonce) - 8
+	binary.BigEndian.PutUint64(nonce[offset:], binary.BigEndian.Uint64(fileNonce[offset:])^uint64(index))
+}
+
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return encryptedChunkAdditionalData[1]
+	}
+	return encryptedChunkAdditionalData[0]
+}
+
+// encryptStream encrypts size bytes read from in to out chunk by chunk, so that
+// memory usage doesn't grow with the file size
+func encryptStream(aead cipher.AEAD, in io.Reader, size int64, out io.Writer) error {
+	header := make([]byte, ENCRYPTED_HEADER_LEN)
+	copy(header, ENCRYPTED_MAGIC)
+	fileNonce := header[len(ENCRYPTED_MAGIC):]
+	if _, err := io.ReadFull(rand.Reader, fileNonce); err != nil {
+		return err
+	}
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	nonce := make([]byte, ENCRYPTED_NONCE_LEN)
+	plaintext := make([]byte, ENCRYPTED_CHUNK_SIZE)
+	sealed := make([]byte, ENCRYPTED_CHUNK_HEADER_LEN, ENCRYPTED_CHUNK_HEADER_LEN+ENCRYPTED_CHUNK_SIZE+aead.Overhead())
+	chunks := encryptedChunks(size)
+	for i := int64(0); i < chunks; i++ {
+		n := size - i*ENCRYPTED_CHUNK_SIZE
+		if n > ENCRYPTED_CHUNK_SIZE {
+			n = ENCRYPTED_CHUNK_SIZE
+		}
+		if _, err := io.ReadFull(in, plaintext[:n]); err != nil {
+			return err
+		}
+		last := i == chunks-1
+		chunkNonce(nonce, fileNonce, i)
+		sealed = aead.Seal(sealed[:ENCRYPTED_CHUNK_HEADER_LEN], nonce, plaintext[:n], chunkAdditionalData(last))
+		length := uint32(len(sealed) - ENCRYPTED_CHUNK_HEADER_LEN)
+		if last {
+			length |= ENCRYPTED_LAST_CHUNK
+		}
+		binary.BigEndian.PutUint32(sealed, length)
+		if _, err := out.Write(sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptFile writes the encrypted content of src to dst with a random nonce.
+// It's written to dst with ENCRYPTING_SUFFIX and renamed after synced if
+// syncOnClose, the incomplete file is removed if anything goes wrong
+func encryptFile(aead cipher.AEAD, src, dst string, syncOnClose bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tempDst := dst + ENCRYPTING_SUFFIX
+	out, err := os.OpenFile(tempDst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = encryptStream(aead, in, info.Size(), out)
+	if err == nil && syncOnClose {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempDst, dst)
+	}
+	if err != nil {
+		os.Remove(tempDst)
+	}
+	return err
+}
+
+// encryptTempFile encrypts a finished temp file to filename with ENCRYPTED_SUFFIX.
+// The plaintext temp file is only removed after encryption succeeds, otherwise
+// it's kept for markAndCleanTempFiles to encrypt again on restart.
+func encryptTempFile(aead cipher.AEAD, tempFilename, filename string, syncOnClose bool) error {
+	if err := encryptFile(aead, tempFilename, filename+ENCRYPTED_SUFFIX, syncOnClose); err != nil {
+		return err
+	}
+	return os.Remove(tempFilename)
+}
+
+// DecryptFile writes the pcap content of a file encrypted with OptionEncryptionKey
+// to out, it fails if the file is corrupted or truncated. Content of the chunks
+// before the failure may have been written to out.
+func DecryptFile(key []byte, filename string, out io.Writer) error {
+	aead, err := newEncryptionCipher(func() ([]byte, error) { return key, nil })
+	if err != nil {
+		return err
+	}
+	return decryptFile(aead, filename, out)
+}
+
+func decryptFile(aead cipher.AEAD, filename string, out io.Writer) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	in := bufio.NewReader(file)
+
+	header := make([]byte, ENCRYPTED_HEADER_LEN)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:len(ENCRYPTED_MAGIC)]) != ENCRYPTED_MAGIC {
+		return fmt.Errorf("%s is not an encrypted pcap file", filename)
+	}
+	fileNonce := header[len(ENCRYPTED_MAGIC):]
+	nonce := make([]byte, ENCRYPTED_NONCE_LEN)
+	chunkHeader := make([]byte, ENCRYPTED_CHUNK_HEADER_LEN)
+	sealed := make([]byte, ENCRYPTED_CHUNK_SIZE+aead.Overhead())
+	plaintext := make([]byte, 0, ENCRYPTED_CHUNK_SIZE)
+	for i := int64(0); ; i++ {
+		if _, err := io.ReadFull(in, chunkHeader); err != nil {
+			return fmt.Errorf("%s is truncated at chunk %d", filename, i)
+		}
+		length := binary.BigEndian.Uint32(chunkHeader)
+		last := length&ENCRYPTED_LAST_CHUNK != 0
+		length &^= ENCRYPTED_LAST_CHUNK
+		if int(length) > len(sealed) {
+			return fmt.Errorf("%s has invalid chunk length %d at chunk %d", filename, length, i)
+		}
+		if _, err := io.ReadFull(in, sealed[:length]); err != nil {
+			return fmt.Errorf("%s is truncated at chunk %d", filename, i)
+		}
+		chunkNonce(nonce, fileNonce, i)
+		if plaintext, err = aead.Open(plaintext[:0], nonce, sealed[:length], chunkAdditionalData(last)); err != nil {
+			return fmt.Errorf("failed to decrypt chunk %d of %s: %s", i, filename, err)
+		}
+		if _, err := out.Write(plaintext); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if _, err := in.Peek(1); err != io.EOF {
+		return fmt.Errorf("%s has data after the last chunk", filename)
+	}
+	return nil
+}
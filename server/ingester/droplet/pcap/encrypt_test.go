@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestEncryptFinishedFile(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionEncryptionKey(key))
+	var err error
+	if m.encryption, err = newEncryptionCipher(m.getEncryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	w := m.newWorker(0)
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	waitFinished(w)
+
+	files, _ := filepath.Glob(filepath.Join(m.baseDirectory, "1", "*"))
+	if len(files) != 1 || filepath.Ext(files[0]) != ENCRYPTED_SUFFIX {
+		t.Fatalf("expected a single encrypted file, got %v", files)
+	}
+	plaintext := &bytes.Buffer{}
+	if err := DecryptFile(key, files[0], plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext.Len() != GLOBAL_HEADER_LEN+RECORD_HEADER_LEN+100 {
+		t.Errorf("unexpected decrypted length %d", plaintext.Len())
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(m.baseDirectory, "1", "*"+ENCRYPTING_SUFFIX)); len(leftovers) > 0 {
+		t.Errorf("incomplete encrypted files are left: %v", leftovers)
+	}
+	if content, _ := os.ReadFile(files[0]); bytes.Contains(content, newRawPacket(0, 100).RawHeader) {
+		t.Error("packet content is stored in plaintext")
+	}
+}
+
+func TestEncryptedFileInfoBytes(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	var infos []*FileInfo
+	var mu sync.Mutex
+	done := make(chan struct{})
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionEncryptionKey(key),
+		OptionOnFileFinalized(func(info *FileInfo) {
+			mu.Lock()
+			infos = append(infos, info)
+			mu.Unlock()
+			close(done)
+		}))
+	var err error
+	if m.encryption, err = newEncryptionCipher(m.getEncryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	w := m.newWorker(0)
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("file is not finalized")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	stat, err := os.Stat(infos[0].Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 回调中的大小应为加密后落盘的大小
+	if infos[0].Bytes != stat.Size() {
+		t.Errorf("FileInfo.Bytes is %d, file size on disk is %d", infos[0].Bytes, stat.Size())
+	}
+}
+
+func TestEncryptChunks(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	aead, _ := newEncryptionCipher(func() ([]byte, error) { return key, nil })
+	dir := t.TempDir()
+	for _, size := range []int{0, 1, ENCRYPTED_CHUNK_SIZE, ENCRYPTED_CHUNK_SIZE*2 + 7} {
+		plaintext := make([]byte, size)
+		for i := range plaintext {
+			plaintext[i] = byte(i)
+		}
+		src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+		os.WriteFile(src, plaintext, 0644)
+		if err := encryptFile(aead, src, dst, true); err != nil {
+			t.Fatal(err)
+		}
+		stat, _ := os.Stat(dst)
+		if stat.Size() != encryptedSize(aead, int64(size)) {
+			t.Errorf("size %d: encrypted size %d, expected %d", size, stat.Size(), encryptedSize(aead, int64(size)))
+		}
+		decrypted := &bytes.Buffer{}
+		if err := decryptFile(aead, dst, decrypted); err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("size %d: decrypted content mismatch", size)
+		}
+
+		// 截断到任意块边界或块内部都应能检测到
+		for _, cut := range []int64{1, int64(ENCRYPTED_CHUNK_HEADER_LEN + aead.Overhead())} {
+			if cut >= stat.Size()-int64(ENCRYPTED_HEADER_LEN) {
+				continue
+			}
+			os.Truncate(dst, stat.Size()-cut)
+			if err := decryptFile(aead, dst, io.Discard); err == nil {
+				t.Errorf("size %d: truncation of %d bytes is not detected", size, cut)
+			}
+		}
+	}
+}
+
+func TestEncryptionInvalidKey(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("short")} {
+		m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionEncryptionKey(key))
+		if closers := m.Start(); closers != nil {
+			t.Errorf("manager should not start with key %v", key)
+		}
+	}
+}
+
+func TestEncryptionFailureKeepsTempFile(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionEncryptionKey(key))
+	var err error
+	if m.encryption, err = newEncryptionCipher(m.getEncryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	w := m.newWorker(0)
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	writer := w.writers[zerodoc.CLOUD][getWriterKey(0, 0, 1)]
+	// 加密输出的位置被目录占用，加密失败
+	blocker := w.getFilename(writer) + ENCRYPTED_SUFFIX + ENCRYPTING_SUFFIX
+	os.MkdirAll(blocker, 0755)
+	w.cleanTimeoutFile(time.Hour)
+	waitFinished(w)
+	if w.EncryptionFailures != 1 {
+		t.Fatalf("expected 1 encryption failure, got %d", w.EncryptionFailures)
+	}
+	if _, err := os.Stat(writer.tempFilename); err != nil {
+		t.Fatalf("temp file should be kept after encryption failure: %s", err)
+	}
+
+	// 重启时再次加密
+	os.Remove(blocker)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	markAndCleanTempFiles([]string{m.baseDirectory}, m.encryption, false, false, nil, wg)
+	files, _ := filepath.Glob(filepath.Join(m.baseDirectory, "1", "*"))
+	if len(files) != 1 || filepath.Ext(files[0]) != ENCRYPTED_SUFFIX {
+		t.Fatalf("expected the temp file encrypted on restart, got %v", files)
+	}
+	if err := DecryptFile(key, files[0], io.Discard); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"sync/atomic"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+const ETH_FCS_LEN = 4
+
+// stripFCS returns a copy of packet without the trailing Ethernet FCS, or nil
+// if packet is not an Ethernet frame long enough to carry one. RawHeader is
+// only shortened if it reaches into the FCS, e.g. the whole frame is captured,
+// while PacketLen always drops the FCS, so that incl_len and orig_len are
+// consistent with sources stripping it. The returned packet is valid until
+// the next call.
+func (w *Worker) stripFCS(packet *datatype.MetaPacket, linkType layers.LinkType) *datatype.MetaPacket {
+	if linkType != layers.LinkTypeEthernet || int(packet.PacketLen) < datatype.ETH_HEADER_SIZE+ETH_FCS_LEN {
+		return nil
+	}
+	frameLen := packet.PacketLen - ETH_FCS_LEN
+	w.fcsStrippedPacket = *packet
+	w.fcsStrippedPacket.PacketLen = frameLen
+	if packet.RawHeaderSize > frameLen {
+		w.fcsStrippedPacket.RawHeader = packet.RawHeader[:frameLen]
+		w.fcsStrippedPacket.RawHeaderSize = frameLen
+	}
+	atomic.AddUint64(&w.FCSStrippedPackets, 1)
+	return &w.fcsStrippedPacket
+}
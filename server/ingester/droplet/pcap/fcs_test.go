@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestStripFCS(t *testing.T) {
+	full := newRawPacket(time.Second, 68)
+	header := newRawPacket(2*time.Second, 40)
+	header.PacketLen = 1504
+	ip := newRawPacket(3*time.Second, 40) // LinkTypeRaw没有FCS
+	ip.RawHeader[0], ip.EthType = 0x45, layers.EthernetTypeIPv4
+
+	for _, withFCS := range []bool{true, false} {
+		w := newTestWorker(t, OptionPacketsWithFCS(withFCS))
+		w.writePacket(full, zerodoc.CLOUD, 1)
+		w.writePacket(header, zerodoc.CLOUD, 1)
+		w.writePacket(ip, zerodoc.CLOUD, 2)
+		w.cleanTimeoutFile(time.Hour)
+
+		expected := []struct{ inclLen, origLen int }{{68, 68}, {40, 1504}}
+		if withFCS {
+			expected = []struct{ inclLen, origLen int }{{64, 64}, {40, 1500}}
+			// LinkTypeRaw的包不计数
+			if w.FCSStrippedPackets != 2 {
+				t.Errorf("expected 2 packets with FCS stripped, got %d", w.FCSStrippedPackets)
+			}
+		} else if w.FCSStrippedPackets != 0 {
+			t.Errorf("FCS should not be stripped by default")
+		}
+		files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+		if len(files) != 1 {
+			t.Fatalf("expected 1 file, got %v", files)
+		}
+		records, err := readAll(t, files[0])
+		if err != nil || len(records) != len(expected) {
+			t.Fatalf("expected %d records, got %d: %v", len(expected), len(records), err)
+		}
+		for i, record := range records {
+			if len(record.Data) != expected[i].inclLen || record.OrigLen != expected[i].origLen {
+				t.Errorf("with FCS %v, record %d: expected lengths %v, got %d %d", withFCS, i, expected[i], len(record.Data), record.OrigLen)
+			}
+		}
+		if !bytes.Equal(records[0].Data, full.RawHeader[:expected[0].inclLen]) {
+			t.Errorf("with FCS %v: unexpected data of the full frame", withFCS)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestFilenameFormatter(t *testing.T) {
+	formatter := func(writer *WrappedWriter, base string) string {
+		return fmt.Sprintf("%s/custom/%d-%d-%d.pcap", base, writer.AclGID(), writer.FirstPacketTime()/time.Second, writer.LastPacketTime()/time.Second)
+	}
+	w := newTestWorker(t, OptionFilenameFormatter(formatter))
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(2*time.Second, 64), zerodoc.CLOUD, 1)
+	for _, writer := range w.writers[zerodoc.CLOUD] {
+		if writer.tempFilename != filepath.Join(w.baseDirectory, "custom/1-1-1.pcap.temp") {
+			t.Errorf("unexpected temp filename %s", writer.tempFilename)
+		}
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if _, err := os.Stat(filepath.Join(w.baseDirectory, "custom/1-1-2.pcap")); err != nil {
+		t.Error(err)
+	}
+
+	// 目录外的路径，以及清理程序不识别的后缀
+	for _, name := range []string{"/tmp/escaped.pcap", "%s/../escaped.pcap", "%s", "%s/custom.txt", "%s/custom.pcap.gz", "%s/custom"} {
+		name := name
+		w = newTestWorker(t, OptionFilenameFormatter(func(writer *WrappedWriter, base string) string {
+			return strings.ReplaceAll(name, "%s", base)
+		}))
+		w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+		for _, writer := range w.writers[zerodoc.CLOUD] {
+			if writer.customFilename || !isTempFilename(filepath.Base(writer.tempFilename)) {
+				t.Errorf("path %s should fall back to the default format, got %s", name, writer.tempFilename)
+			}
+		}
+		if w.InvalidFilenames != 1 {
+			t.Errorf("expected 1 invalid filename, got %d", w.InvalidFilenames)
+		}
+		w.cleanTimeoutFile(time.Hour)
+		if files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap")); len(files) != 1 {
+			t.Errorf("path %s should be finished with the default format, got %v", name, files)
+		}
+	}
+}
+
+func TestTapTypeDirectory(t *testing.T) {
+	w := newTestWorker(t, OptionTapTypeDirectory(true))
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.TAPTypeEnum(2), 1)
+	w.cleanTimeoutFile(time.Hour)
+
+	for _, tapType := range []string{"tor", "isp2"} {
+		files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", tapType, "*.pcap"))
+		if len(files) != 1 {
+			t.Fatalf("expected 1 file in %s directory, got %v", tapType, files)
+		}
+		info, err := ParseFilename(files[0], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.AclGID != 1 || tapTypeToString(info.TapType) != tapType {
+			t.Errorf("unexpected info %+v parsed from %s", info, files[0])
+		}
+	}
+}
+
+func TestRenameFailure(t *testing.T) {
+	w := newTestWorker(t)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	var writer *WrappedWriter
+	for _, writer = range w.writers[zerodoc.CLOUD] {
+	}
+	// 目标位置是非空目录，重命名必然失败
+	newFilename := w.getFilename(writer)
+	os.MkdirAll(filepath.Join(newFilename, "occupied"), os.ModePerm)
+	w.finishWriter(writer, newFilename)
+	if w.FileRenameFailures != 1 || w.FileCloses != 0 || w.WriterCount() != 0 {
+		t.Errorf("expected 1 rename failure and no close, got %d and %d", w.FileRenameFailures, w.FileCloses)
+	}
+	if _, err := os.Stat(writer.tempFilename); err != nil {
+		t.Errorf("temp file should be kept: %s", err)
+	}
+}
+
+func TestRenameCrossDevice(t *testing.T) {
+	rename = func(src, dst string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+	}
+	defer func() { rename = os.Rename }()
+
+	w := newTestWorker(t)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	if w.FileRenameFailures != 0 || w.FileCloses != 1 {
+		t.Errorf("cross-device rename should fall back to copy, got %d failures", w.FileRenameFailures)
+	}
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*"))
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".pcap") {
+		t.Errorf("expected only the finished file, got %v", files)
+	}
+}
+
+func TestOnFileFinalized(t *testing.T) {
+	finalized := make(chan *FileInfo, 1)
+	w := newTestWorker(t, OptionOnFileFinalized(func(info *FileInfo) { finalized <- info }))
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(2*time.Second, 100), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+
+	select {
+	case info := <-finalized:
+		if info.TapType != zerodoc.CLOUD || info.AclGID != 1 || info.PacketCount != 2 || info.StartTime != time.Second || info.EndTime != 2*time.Second {
+			t.Errorf("unexpected file info %+v", info)
+		}
+		if stat, err := os.Stat(info.Filename); err != nil || stat.Size() != info.Bytes || info.Bytes != GLOBAL_HEADER_LEN+2*(RECORD_HEADER_LEN+100) {
+			t.Errorf("file info does not match the finalized file: %+v %v", info, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("callback not invoked")
+	}
+}
+
+func TestStructuredLog(t *testing.T) {
+	w := newTestWorker(t, OptionStructuredLog(true), OptionMaxPacketsPerFile(2))
+	var events []*Event
+	w.events.output = func(line string) {
+		event := &Event{}
+		if err := json.Unmarshal([]byte(line), event); err != nil {
+			t.Errorf("invalid event %s: %s", line, err)
+		}
+		events = append(events, event)
+	}
+	for i := 0; i < 3; i++ {
+		w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected create, close and create events, got %d", len(events))
+	}
+	if e := events[1]; e.Event != EVENT_FILE_CLOSE || e.AclGID != 1 || e.TapType != "tor" || e.Packets != 2 ||
+		e.Bytes != GLOBAL_HEADER_LEN+2*(RECORD_HEADER_LEN+100) || e.Error != "" {
+		t.Errorf("unexpected close event %+v", e)
+	}
+	if events[0].Event != EVENT_FILE_CREATE || events[0].Filename == "" {
+		t.Errorf("unexpected create event %+v", events[0])
+	}
+
+	if newTestWorker(t).events != nil {
+		t.Error("structured log should be disabled by default")
+	}
+}
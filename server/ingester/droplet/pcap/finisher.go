@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// finisher runs the work of finishing closed files in the background, i.e.
+// encryption and sync, which takes time proportional to the file size and
+// would otherwise block Process with writersLock held
+type finisher struct {
+	jobs    chan func()
+	backlog *uint64 // jobs queued or running
+	done    chan struct{}
+}
+
+func newFinisher(backlog *uint64) *finisher {
+	f := &finisher{
+		jobs:    make(chan func(), FINISHER_QUEUE_SIZE),
+		backlog: backlog,
+		done:    make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+func (f *finisher) run() {
+	for job := range f.jobs {
+		job()
+		atomic.AddUint64(f.backlog, ^uint64(0))
+	}
+	close(f.done)
+}
+
+// close waits for all queued jobs to finish
+func (f *finisher) close() {
+	close(f.jobs)
+	<-f.done
+}
+
+// finish runs job in the finisher if any, otherwise in place. Process blocks
+// if FINISHER_QUEUE_SIZE jobs are pending.
+func (w *Worker) finish(job func()) {
+	if w.finisher == nil {
+		job()
+		return
+	}
+	atomic.AddUint64(&w.FinishBacklog, 1)
+	w.finisher.jobs <- job
+}
+
+// syncFile flushes a closed file to disk
+func syncFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+// waitFinished waits for the finisher of w to finish all closed files
+func waitFinished(w *Worker) {
+	for atomic.LoadUint64(&w.FinishBacklog) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFinishInBackground(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionEncryptionKey(key))
+	var err error
+	if m.encryption, err = newEncryptionCipher(m.getEncryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	w := m.newWorker(0)
+	if w.finisher == nil {
+		t.Fatal("encrypted files should be finished in the background")
+	}
+	// 阻塞finisher，关闭文件不应等待加密
+	release := make(chan struct{})
+	w.finish(func() { <-release })
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	if w.WriterCount() != 0 || w.FinishBacklog != 2 {
+		t.Errorf("expected the file closed with 2 jobs in backlog, got %d writers and %d jobs", w.WriterCount(), w.FinishBacklog)
+	}
+	if files, _ := filepath.Glob(filepath.Join(m.baseDirectory, "1", "*"+ENCRYPTED_SUFFIX)); len(files) != 0 {
+		t.Errorf("file should not be encrypted before the finisher runs, got %v", files)
+	}
+
+	close(release)
+	waitFinished(w)
+	if files, _ := filepath.Glob(filepath.Join(m.baseDirectory, "1", "*")); len(files) != 1 || filepath.Ext(files[0]) != ENCRYPTED_SUFFIX {
+		t.Errorf("expected a single encrypted file, got %v", files)
+	}
+	if w.FileCloses != 1 {
+		t.Errorf("expected 1 file close, got %d", w.FileCloses)
+	}
+}
+
+func TestFinisherEnabled(t *testing.T) {
+	w := newTestWorker(t)
+	if w.finisher != nil {
+		t.Error("renaming files should not need a finisher")
+	}
+	w = newTestWorker(t, OptionSyncOnClose(true))
+	if w.finisher == nil {
+		t.Fatal("synced files should be finished in the background")
+	}
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	w.finisher.close()
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 1 || packets != 1 {
+		t.Errorf("expected 1 packet in 1 file after the finisher is closed, got %d in %d", packets, files)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+// 每份额外格式都会增加一倍写入，限制其数量
+const MAX_EXTRA_OUTPUT_FORMATS = 2
+
+// OutputFormat is an extra copy of each capture written with a different snaplen,
+// e.g. a headers-only copy for quick scanning besides the full one for forensics
+type OutputFormat struct {
+	Name    string // inserted before the .pcap extension of filenames
+	Snaplen int
+}
+
+// validateOutputFormats drops invalid formats and the ones exceeding MAX_EXTRA_OUTPUT_FORMATS
+func validateOutputFormats(formats []OutputFormat) []OutputFormat {
+	var valid []OutputFormat
+	names := make(map[string]bool)
+	for _, format := range formats {
+		if format.Name == "" || sanitizeNodeID(format.Name) != format.Name || names[format.Name] {
+			log.Warningf("ignore pcap output format with invalid or duplicated name %q", format.Name)
+			continue
+		}
+		if len(valid) >= MAX_EXTRA_OUTPUT_FORMATS {
+			log.Warningf("ignore pcap output format %s, at most %d extra formats are supported", format.Name, MAX_EXTRA_OUTPUT_FORMATS)
+			continue
+		}
+		// 由MetaPacket还原的包头不截断，snaplen不能小于其最大长度
+		if format.Snaplen < MAX_HEADER_LEN {
+			format.Snaplen = MAX_HEADER_LEN
+		}
+		names[format.Name] = true
+		valid = append(valid, format)
+	}
+	return valid
+}
+
+// withFormat inserts the format name before the .pcap extension, e.g.
+// a.00001.pcap is a.00001.hdr.pcap in the hdr format
+func withFormat(filename, format string) string {
+	if strings.HasSuffix(filename, ".pcap") {
+		return strings.TrimSuffix(filename, ".pcap") + "." + format + ".pcap"
+	}
+	return filename + "." + format
+}
+
+type formatWriter struct {
+	*Writer
+	format       string
+	tempFilename string
+}
+
+// openExtraWriters is called after the main writer of a capture is opened, a
+// format failed to open is skipped for this capture
+func (w *Worker) openExtraWriters(writer *WrappedWriter, recovered bool) {
+	for _, format := range w.extraFormats {
+		extra := &formatWriter{
+			format:       format.Name,
+			tempFilename: withFormat(strings.TrimSuffix(writer.tempFilename, TEMP_SUFFIX), format.Name) + TEMP_SUFFIX,
+		}
+		if w.dryRun {
+			extra.Writer = NewDryRunWriter(extra.tempFilename, w.writerBufferSize, format.Snaplen, writer.LinkType(), w.tcpipChecksum)
+			writer.extraWriters = append(writer.extraWriters, extra)
+			continue
+		}
+		if w.recoverable != nil {
+			// 主文件恢复时继续追加同名的临时文件，否则结束上次遗留的文件
+			if file := w.recoverable.take(recoveryKey(extra.tempFilename)); file != nil && (!recovered || file.tempFilename != extra.tempFilename) {
+				finishTempFile(file.tempFilename, file.lastPacketTime, w.encryption, w.syncOnClose)
+			}
+		}
+		var err error
+		if extra.Writer, err = NewWriter(extra.tempFilename, w.writerBufferSize, format.Snaplen, writer.LinkType(), w.tcpipChecksum); err != nil {
+			log.Debugf("Failed to create writer for %s: %s", extra.tempFilename, err)
+			atomic.AddUint64(&w.FileCreationFailures, 1)
+			continue
+		}
+		writer.extraWriters = append(writer.extraWriters, extra)
+	}
+}
+
+// writeExtraWriters writes the packet written to the main writer to extra formats
+func (w *Worker) writeExtraWriters(writer *WrappedWriter, packet *datatype.MetaPacket) {
+	extraWriters := writer.extraWriters[:0]
+	for _, extra := range writer.extraWriters {
+		if err := extra.Write(packet); err != nil {
+			log.Debugf("Failed to write packet to %s: %s", extra.tempFilename, err)
+			atomic.AddUint64(&w.FileWritingFailures, 1)
+			if w.quarantineOnWriteFailure {
+				// 只隔离出错的格式，其他格式继续写入
+				w.quarantineFile(extra.Writer, extra.tempFilename)
+				atomic.AddUint64(&w.FailedCaptures, 1)
+				continue
+			}
+		} else {
+			counter := extra.GetAndResetStats()
+			w.addWriterCounter(&counter)
+			atomic.AddUint64(&w.ExtraFormatBytes, counter.totalBufferedBytes)
+		}
+		extraWriters = append(extraWriters, extra)
+	}
+	writer.extraWriters = extraWriters
+}
+
+// closeExtraWriters returns the error of closing each extra format
+func (w *Worker) closeExtraWriters(writer *WrappedWriter) []error {
+	if len(writer.extraWriters) == 0 {
+		return nil
+	}
+	errs := make([]error, len(writer.extraWriters))
+	for i, extra := range writer.extraWriters {
+		errs[i] = w.closeFile(extra.Writer, extra.tempFilename)
+	}
+	return errs
+}
+
+// finalizeExtraWriters renames extra formats after the main file, newFilename
+// is the final name of the main file without ENCRYPTED_SUFFIX
+func (w *Worker) finalizeExtraWriters(writer *WrappedWriter, newFilename string, errs []error) {
+	for i, extra := range writer.extraWriters {
+		if errs[i] != nil {
+			w.quarantineTempFile(extra.tempFilename)
+			continue
+		}
+		filename, finalized, _ := w.finalizeFile(extra.tempFilename, withFormat(newFilename, extra.format))
+		if finalized && w.onFileFinalized != nil {
+			go w.onFileFinalized(&FileInfo{
+				Filename:    filename,
+				Format:      extra.format,
+				TapType:     writer.tapType,
+				AclGID:      writer.aclGID,
+				PacketCount: writer.packetCount,
+				Bytes:       w.finishedSize(extra.FileSize()),
+				StartTime:   writer.firstPacketTime,
+				EndTime:     writer.lastPacketTime,
+			})
+		}
+	}
+}
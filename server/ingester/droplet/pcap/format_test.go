@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestValidateOutputFormats(t *testing.T) {
+	formats := validateOutputFormats([]OutputFormat{
+		{Name: "hdr", Snaplen: 64},
+		{Name: ""},
+		{Name: "a.b", Snaplen: 256},
+		{Name: "hdr", Snaplen: 256},
+		{Name: "mid", Snaplen: 512},
+		{Name: "more", Snaplen: 1024},
+	})
+	if len(formats) != MAX_EXTRA_OUTPUT_FORMATS || formats[0].Name != "hdr" || formats[1].Name != "mid" {
+		t.Fatalf("unexpected formats %v", formats)
+	}
+	if formats[0].Snaplen != MAX_HEADER_LEN {
+		t.Errorf("snaplen should be at least %d, got %d", MAX_HEADER_LEN, formats[0].Snaplen)
+	}
+	if name := withFormat("a_b.00001.pcap", "hdr"); name != "a_b.00001.hdr.pcap" {
+		t.Errorf("unexpected filename %s", name)
+	}
+}
+
+func TestExtraOutputFormats(t *testing.T) {
+	var finalized []*FileInfo
+	done := make(chan *FileInfo)
+	w := newTestWorker(t, OptionExtraOutputFormats{{Name: "hdr", Snaplen: 200}}, OptionOnFileFinalized(func(info *FileInfo) { done <- info }))
+	w.writePacket(newRawPacket(time.Second, 1000), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(2*time.Second, 1000), zerodoc.CLOUD, 1)
+	if w.WriterCount() != 1 {
+		t.Errorf("extra formats should not count as concurrent files, got %d", w.WriterCount())
+	}
+	w.cleanTimeoutFile(time.Hour)
+	finalized = append(finalized, <-done, <-done)
+
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %v", files)
+	}
+	for _, file := range files {
+		info, err := ParseFilename(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := readAll(t, file)
+		if err != nil || len(records) != 2 {
+			t.Fatalf("expected 2 records in %s, got %d: %v", file, len(records), err)
+		}
+		inclLen := 1000
+		if strings.HasSuffix(file, ".hdr.pcap") {
+			if info.Format != "hdr" {
+				t.Errorf("expected hdr format parsed from %s, got %q", file, info.Format)
+			}
+			inclLen = 200
+		}
+		if len(records[0].Data) != inclLen || records[0].OrigLen != 1000 {
+			t.Errorf("expected %d bytes captured in %s, got %d", inclLen, file, len(records[0].Data))
+		}
+	}
+
+	extraBytes := uint64(GLOBAL_HEADER_LEN + 2*(RECORD_HEADER_LEN+200))
+	if w.ExtraFormatBytes != extraBytes || w.BufferedBytes != extraBytes+GLOBAL_HEADER_LEN+2*(RECORD_HEADER_LEN+1000) {
+		t.Errorf("unexpected bytes %d of extra formats and %d in total", w.ExtraFormatBytes, w.BufferedBytes)
+	}
+	if finalized[0].Format == finalized[1].Format {
+		t.Errorf("expected callbacks for both formats, got %+v and %+v", finalized[0], finalized[1])
+	}
+}
@@ -32,7 +32,7 @@ const (
 
 type GlobalHeader []byte
 
-func NewGlobalHeader(buffer []byte, snaplen uint32) GlobalHeader {
+func NewGlobalHeader(buffer []byte, snaplen uint32, linkType layers.LinkType) GlobalHeader {
 	offset := 0
 	// magic_number 4B
 	binary.LittleEndian.PutUint32(buffer[offset:], PCAP_MAGIC)
@@ -49,7 +49,7 @@ func NewGlobalHeader(buffer []byte, snaplen uint32) GlobalHeader {
 	binary.LittleEndian.PutUint32(buffer[offset:], snaplen)
 	offset += 4
 	// network 4B
-	binary.LittleEndian.PutUint32(buffer[offset:], uint32(layers.LinkTypeEthernet))
+	binary.LittleEndian.PutUint32(buffer[offset:], uint32(linkType))
 	return buffer
 }
 
@@ -81,3 +81,29 @@ func (h RecordHeader) SetInclLen(inclLen int) {
 func (h RecordHeader) SetOrigLen(origLen int) {
 	binary.LittleEndian.PutUint32(h[ORIG_LEN_OFFSET:], uint32(origLen))
 }
+
+func (h GlobalHeader) Magic() uint32 {
+	return binary.LittleEndian.Uint32(h[0:])
+}
+
+func (h GlobalHeader) Snaplen() uint32 {
+	return binary.LittleEndian.Uint32(h[16:])
+}
+
+func (h GlobalHeader) LinkType() layers.LinkType {
+	return layers.LinkType(binary.LittleEndian.Uint32(h[20:]))
+}
+
+func (h RecordHeader) Timestamp() time.Duration {
+	sec := binary.LittleEndian.Uint32(h[TS_SEC_OFFSET:])
+	usec := binary.LittleEndian.Uint32(h[TS_USEC_OFFSET:])
+	return time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond
+}
+
+func (h RecordHeader) InclLen() int {
+	return int(binary.LittleEndian.Uint32(h[INCL_LEN_OFFSET:]))
+}
+
+func (h RecordHeader) OrigLen() int {
+	return int(binary.LittleEndian.Uint32(h[ORIG_LEN_OFFSET:]))
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import "fmt"
+
+// 并发文件数超过上限的该比例时认为不健康
+const CONCURRENT_FILES_WARNING_RATIO = 0.9
+
+type WorkerHealth struct {
+	Index       int
+	Alive       bool
+	WriterCount int
+}
+
+type HealthStatus struct {
+	Healthy bool
+	Reasons []string
+
+	Workers            []WorkerHealth
+	ConcurrentFiles    int
+	MaxConcurrentFiles int
+
+	// counters increased since the last HealthCheck
+	FileCreations        uint64
+	FileRejections       uint64
+	FileCreationFailures uint64
+	FileWritingFailures  uint64
+	EncryptionFailures   uint64
+	FileRenameFailures   uint64
+}
+
+func (s *HealthStatus) addReason(format string, a ...interface{}) {
+	s.Healthy = false
+	s.Reasons = append(s.Reasons, fmt.Sprintf(format, a...))
+}
+
+// HealthCheck summarizes the state of all workers, it's safe to be called
+// concurrently with packet processing
+func (m *WorkerManager) HealthCheck() *HealthStatus {
+	m.healthLock.Lock()
+	defer m.healthLock.Unlock()
+
+	status := &HealthStatus{Healthy: true, MaxConcurrentFiles: m.maxConcurrentFiles}
+	if len(m.workers) == 0 || m.workers[0] == nil {
+		status.addReason("pcap workers are not started")
+		return status
+	}
+	if m.lastHealthCounters == nil {
+		m.lastHealthCounters = make([]WorkerCounter, len(m.workers))
+	}
+
+	for i, w := range m.workers {
+		health := WorkerHealth{Index: i, Alive: !w.Closed(), WriterCount: w.WriterCount()}
+		if !health.Alive {
+			status.addReason("pcap worker %d is closed", i)
+		}
+		// 并发文件数上限是按worker均分的
+		if float64(health.WriterCount) >= float64(w.maxConcurrentFiles)*CONCURRENT_FILES_WARNING_RATIO {
+			status.addReason("pcap worker %d has %d concurrent files, close to the limit %d", i, health.WriterCount, w.maxConcurrentFiles)
+		}
+		status.Workers = append(status.Workers, health)
+		status.ConcurrentFiles += health.WriterCount
+
+		total := w.Snapshot()
+		last := &m.lastHealthCounters[i]
+		status.FileCreations += total.FileCreations - last.FileCreations
+		status.FileRejections += total.FileRejections - last.FileRejections
+		status.FileCreationFailures += total.FileCreationFailures - last.FileCreationFailures
+		status.FileWritingFailures += total.FileWritingFailures - last.FileWritingFailures
+		status.EncryptionFailures += total.EncryptionFailures - last.EncryptionFailures
+		status.FileRenameFailures += total.FileRenameFailures - last.FileRenameFailures
+		*last = total
+	}
+
+	if status.FileCreationFailures > 0 {
+		status.addReason("%d file creation failures", status.FileCreationFailures)
+	}
+	if status.FileWritingFailures > 0 {
+		status.addReason("%d file writing failures", status.FileWritingFailures)
+	}
+	if status.EncryptionFailures > 0 {
+		status.addReason("%d encryption failures", status.EncryptionFailures)
+	}
+	if status.FileRenameFailures > 0 {
+		status.addReason("%d file rename failures", status.FileRenameFailures)
+	}
+	if status.FileRejections > 0 {
+		status.addReason("%d files rejected by max-concurrent-files", status.FileRejections)
+	}
+	return status
+}
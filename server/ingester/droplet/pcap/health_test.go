@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestHealthCheck(t *testing.T) {
+	m := NewWorkerManager([]queue.QueueReader{nil, nil}, nil, false, 64, 4, 25, 300, 100, 10, t.TempDir())
+	if status := m.HealthCheck(); status.Healthy {
+		t.Error("manager not started should be unhealthy")
+	}
+	m.workers[0], m.workers[1] = m.newWorker(0), m.newWorker(1)
+	if status := m.HealthCheck(); !status.Healthy || len(status.Workers) != 2 {
+		t.Errorf("idle workers should be healthy, got %+v", status)
+	}
+
+	w := m.workers[1]
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.FileWritingFailures++
+	w.GetCounter() // counters collected by stats should still be seen
+	status := m.HealthCheck()
+	if status.Healthy || status.FileCreations != 1 || status.FileWritingFailures != 1 || status.ConcurrentFiles != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.Workers[1].WriterCount != 1 || !status.Workers[1].Alive {
+		t.Errorf("unexpected worker status %+v", status.Workers[1])
+	}
+
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 2)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 3)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 4)
+	if status = m.HealthCheck(); status.FileRejections != 2 || status.ConcurrentFiles != 2 || len(status.Reasons) != 2 {
+		t.Errorf("expected rejection and near limit reasons, got %v", status.Reasons)
+	}
+
+	w.cleanTimeoutFile(time.Hour)
+	atomic.StoreInt32(&w.exited, 1)
+	status = m.HealthCheck()
+	if status.FileWritingFailures != 0 || status.ConcurrentFiles != 0 || len(status.Reasons) != 1 {
+		t.Errorf("only the closed worker should be reported, got %v", status.Reasons)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// updateIdleBackoff counts consecutive Gets returning ticks only. Gets blocks
+// until packets or ticks arrive, so packets are processed without delay and
+// stop the backoff at once.
+func (w *Worker) updateIdleBackoff(elements []interface{}) {
+	if w.idleBackoffTicks <= 0 {
+		return
+	}
+	for _, e := range elements {
+		if e != nil {
+			w.idleTicks = 0
+			w.idleBackoff = 0
+			return
+		}
+	}
+	if w.idleTicks < w.idleBackoffTicks {
+		w.idleTicks++
+	}
+}
+
+// skipSweep returns true if the expiry sweep of this tick is skipped while
+// idle. The sweep interval starts at idleBackoffMin and doubles after each
+// sweep up to idleBackoffMax, which bounds the delay of finishing files
+// exceeding maxFilePeriod or idleTimeout.
+func (w *Worker) skipSweep(now time.Time) bool {
+	if w.idleBackoffTicks <= 0 || w.idleTicks < w.idleBackoffTicks {
+		w.lastSweepTime = now
+		return false
+	}
+	if w.idleBackoff == 0 {
+		w.idleBackoff = w.idleBackoffMin
+	}
+	if now.Sub(w.lastSweepTime) >= w.idleBackoff {
+		w.lastSweepTime = now
+		if w.idleBackoff *= 2; w.idleBackoff > w.idleBackoffMax {
+			w.idleBackoff = w.idleBackoffMax
+		}
+		return false
+	}
+	atomic.AddUint64(&w.SkippedSweeps, 1)
+	return true
+}
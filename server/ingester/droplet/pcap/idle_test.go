@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+func TestIdleBackoff(t *testing.T) {
+	w := newTestWorker(t, OptionIdleBackoffTicks(2), OptionIdleBackoffMinMs(20000), OptionIdleBackoffMaxMs(30000))
+	ticks := []interface{}{nil}
+	now := time.Unix(1000, 0)
+	tick := func() bool {
+		now = now.Add(10 * time.Second)
+		w.updateIdleBackoff(ticks)
+		return w.skipSweep(now)
+	}
+
+	// 连续2个空闲tick后检查间隔从20s开始翻倍，上限30s
+	expected := []bool{false, true, false, true, true, false, true, true, false, true}
+	for i, skipped := range expected {
+		if tick() != skipped {
+			t.Fatalf("tick %d: expected skipped %v", i, skipped)
+		}
+	}
+	if w.SkippedSweeps != 6 {
+		t.Errorf("expected 6 skipped sweeps, got %d", w.SkippedSweeps)
+	}
+
+	// 收到包后立即恢复每个tick检查
+	block := datatype.AcquireMetaPacketBlock()
+	defer datatype.ReleaseMetaPacketBlock(block)
+	w.updateIdleBackoff([]interface{}{block, nil})
+	if w.skipSweep(now.Add(time.Second)) {
+		t.Error("sweep should not be skipped after packets arrive")
+	}
+	if w.idleBackoff != 0 {
+		t.Errorf("backoff should be reset, got %s", w.idleBackoff)
+	}
+
+	w = newTestWorker(t)
+	for i := 0; i < 10; i++ {
+		if tick() {
+			t.Fatal("sweep should never be skipped by default")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits file creations, it's driven by packet timestamps and
+// shared by all workers, so that they create at most rate files per second in
+// total. Timestamps older than the latest one seen don't refill tokens.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Duration
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = rate
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *tokenBucket) take(now time.Duration) bool {
+	b.Lock()
+	defer b.Unlock()
+	if now > b.last {
+		b.tokens += b.rate * float64(now-b.last) / float64(time.Second)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
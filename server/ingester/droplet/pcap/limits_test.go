@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestFileCreationRate(t *testing.T) {
+	w := newTestWorker(t, OptionFileCreationRate(2), OptionMaxPacketsPerFile(1))
+	for aclGID := uint16(1); aclGID <= 4; aclGID++ {
+		w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, aclGID)
+	}
+	if w.FileCreations != 2 || w.RateLimitedCreations != 2 {
+		t.Errorf("expected 2 creations and 2 rate limited, got %d and %d", w.FileCreations, w.RateLimitedCreations)
+	}
+	// 轮转不受限速影响
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.FileCreations != 4 || w.RateLimitedCreations != 2 {
+		t.Errorf("rotation should not be rate limited, got %d creations and %d rate limited", w.FileCreations, w.RateLimitedCreations)
+	}
+	w.writePacket(newRawPacket(1500*time.Millisecond, 64), zerodoc.CLOUD, 3)
+	if w.FileCreations != 5 {
+		t.Errorf("tokens should be refilled over time, got %d creations", w.FileCreations)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "*", "*.pcap")); files != 5 || packets != 5 {
+		t.Errorf("expected 5 packets in 5 files, got %d packets in %d files", packets, files)
+	}
+}
+
+func TestFileCreationRateShared(t *testing.T) {
+	m := NewWorkerManager([]queue.QueueReader{nil, nil, nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionFileCreationRate(2))
+	workers := []*Worker{m.newWorker(0), m.newWorker(1), m.newWorker(2)}
+	// 速率小于worker数时总创建数也不超过配置，且每个worker都可以创建
+	creations := uint64(0)
+	for i, w := range workers {
+		w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, uint16(i+1))
+		w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, uint16(i+10))
+		creations += w.FileCreations
+	}
+	if creations != 2 || workers[0].FileCreations != 2 {
+		t.Errorf("expected 2 creations in total, got %d", creations)
+	}
+	workers[2].writePacket(newRawPacket(1500*time.Millisecond, 64), zerodoc.CLOUD, 20)
+	if workers[2].FileCreations != 1 {
+		t.Errorf("tokens should be refilled for every worker, got %d creations", workers[2].FileCreations)
+	}
+	for _, w := range workers {
+		w.cleanTimeoutFile(time.Hour)
+	}
+	if files, packets := countPackets(t, filepath.Join(m.baseDirectory, "*", "*.pcap")); files != 3 || packets != 3 {
+		t.Errorf("expected 3 packets in 3 files, got %d packets in %d files", packets, files)
+	}
+}
+
+func TestMaxFilesPerAclGID(t *testing.T) {
+	w := newTestWorker(t, OptionMaxFilesPerAclGID(2))
+	for tapPort := uint32(0); tapPort < 3; tapPort++ {
+		for _, aclGID := range []uint16{1, 2} {
+			packet := newRawPacket(time.Second, 64)
+			packet.TapPort = tapPort
+			w.writePacket(packet, zerodoc.CLOUD, aclGID)
+		}
+	}
+	if w.FileCreations != 4 || w.PerAclGidRejections != 2 {
+		t.Errorf("expected 4 creations and 2 rejections, got %d and %d", w.FileCreations, w.PerAclGidRejections)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if len(w.aclGIDWriterCount) != 0 {
+		t.Errorf("writer count of aclGID should be released, got %v", w.aclGIDWriterCount)
+	}
+	for _, aclGID := range []string{"1", "2"} {
+		if files, packets := countPackets(t, filepath.Join(w.baseDirectory, aclGID, "*.pcap")); files != 2 || packets != 2 {
+			t.Errorf("expected 2 files of aclGID %s, got %d files and %d packets", aclGID, files, packets)
+		}
+	}
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.FileCreations != 5 {
+		t.Error("aclGID should be able to create files again after closing")
+	}
+}
+
+func TestCreateRetry(t *testing.T) {
+	failures := 0
+	mkdirAll = func(path string, perm os.FileMode) error {
+		if failures < 2 {
+			failures++
+			return syscall.EBUSY
+		}
+		return os.MkdirAll(path, perm)
+	}
+	defer func() { mkdirAll = os.MkdirAll }()
+
+	w := newTestWorker(t, OptionCreateRetries(2), OptionCreateRetryBackoffMs(20))
+	start := time.Now()
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if elapsed := time.Since(start); elapsed >= 20*time.Millisecond {
+		t.Errorf("worker should not sleep to retry, took %s", elapsed)
+	}
+	// 退避期内需要新文件的包被丢弃
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.FileCreationFailures != 1 || w.CreationBackoffDrops != 1 || w.CreationRetries != 0 {
+		t.Fatalf("expected 1 failure and 1 drop, got %d and %d", w.FileCreationFailures, w.CreationBackoffDrops)
+	}
+	time.Sleep(20 * time.Millisecond)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.FileCreationFailures != 2 || w.CreationRetries != 1 || w.createRetryTime.Sub(time.Now()) <= 20*time.Millisecond {
+		t.Fatalf("expected the retry to fail with a doubled backoff, got %d failures and %d retries", w.FileCreationFailures, w.CreationRetries)
+	}
+	w.createRetryTime = time.Now()
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.CreationRetries != 2 || w.WriterCount() != 1 || w.createFailures != 0 {
+		t.Errorf("transient failures should be recovered by retries, got %d retries and %d files", w.CreationRetries, w.WriterCount())
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 1 || packets != 1 {
+		t.Errorf("expected only the packet after recovery written, got %d packets in %d files", packets, files)
+	}
+
+	// 不退避时每个包都尝试创建
+	failures = 0
+	w = newTestWorker(t)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.FileCreationFailures != 2 || w.CreationBackoffDrops != 0 || w.WriterCount() != 0 {
+		t.Errorf("expected 2 failures without backoff, got %d failures and %d drops", w.FileCreationFailures, w.CreationBackoffDrops)
+	}
+}
+
+func TestSlowWriteWatchdog(t *testing.T) {
+	w := newTestWorker(t, OptionDropOnSlowWrite(true))
+	w.slowWriteThreshold = time.Nanosecond
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.SlowWrites != 1 || w.SlowWriteDrops != 1 {
+		t.Fatalf("expected 1 slow write and 1 drop, got %d and %d", w.SlowWrites, w.SlowWriteDrops)
+	}
+	// 退避结束后的写入足够快则恢复正常
+	w.slowWriteDropUntil = time.Now().Add(-time.Millisecond)
+	w.slowWriteThreshold = time.Hour
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	if w.SlowWrites != 1 || w.SlowWriteDrops != 1 || !w.slowWriteDropUntil.IsZero() {
+		t.Errorf("worker should recover from slow writes, got %d slow writes and %d drops", w.SlowWrites, w.SlowWriteDrops)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 1 || packets != 3 {
+		t.Errorf("expected 3 packets in 1 file, got %d packets in %d files", packets, files)
+	}
+}
+
+func TestQuarantineOnWriteFailure(t *testing.T) {
+	w := newTestWorker(t, OptionQuarantineOnWriteFailure(true))
+	w.writePacket(newRawPacket(time.Second, 1000), zerodoc.CLOUD, 1)
+	for _, writer := range w.writers[zerodoc.CLOUD] {
+		writer.fp.Close() // 模拟磁盘错误
+	}
+	// 写满两次缓冲区，第二次Flush时返回第一次后台写入的错误
+	for i := 0; i < 200; i++ {
+		w.writePacket(newRawPacket(time.Second, 1000), zerodoc.CLOUD, 1)
+	}
+	if w.FileWritingFailures != 1 || w.FailedCaptures != 1 || w.FileCreations != 2 {
+		t.Errorf("expected 1 write failure, 1 failed capture and 2 creations, got %d, %d and %d", w.FileWritingFailures, w.FailedCaptures, w.FileCreations)
+	}
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*"+TEMP_SUFFIX+QUARANTINE_SUFFIX))
+	if len(files) != 1 {
+		t.Errorf("expected 1 quarantined file, got %v", files)
+	}
+
+	w.cleanTimeoutFile(time.Hour)
+	files, _ = filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if len(files) != 1 {
+		t.Fatalf("expected the new capture finished, got %v", files)
+	}
+	if records, err := readAll(t, files[0]); err != nil || len(records) == 0 {
+		t.Errorf("new capture should be valid, got %d records: %v", len(records), err)
+	}
+}
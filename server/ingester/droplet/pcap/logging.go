@@ -16,6 +16,82 @@
 
 package pcap
 
-import "github.com/op/go-logging"
+import (
+	"encoding/json"
+
+	"github.com/op/go-logging"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
 
 var log = logging.MustGetLogger("pcap")
+
+// eventLog carries the structured events, they go through the same backends as
+// the text logs and can be filtered by module name
+var eventLog = logging.MustGetLogger("pcap.event")
+
+const (
+	EVENT_FILE_CREATE        = "file_create"
+	EVENT_FILE_CLOSE         = "file_close"
+	EVENT_FILE_REJECT        = "file_reject"
+	EVENT_FILE_CREATE_FAILED = "file_create_failed"
+	EVENT_WRITE_FAILED       = "write_failed"
+	EVENT_FILE_QUARANTINE    = "file_quarantine"
+	EVENT_BASE_DIR_CHANGE    = "base_directory_change" // filename is the new base directory
+)
+
+type Event struct {
+	Event    string `json:"event"`
+	Worker   int    `json:"worker"`
+	AclGID   uint16 `json:"acl_gid"`
+	TapType  string `json:"tap_type"`
+	Filename string `json:"filename,omitempty"`
+	Packets  uint64 `json:"packets,omitempty"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// eventLogger emits one JSON line per event, a nil eventLogger discards everything
+// before building the event. Workers only have one with OptionStructuredLog, so
+// nothing is marshalled by default.
+type eventLogger struct {
+	index        int
+	tapTypeNames TapTypeNames
+	output       func(string)
+}
+
+func newEventLogger(index int, tapTypeNames TapTypeNames) *eventLogger {
+	return &eventLogger{
+		index:        index,
+		tapTypeNames: tapTypeNames,
+		output:       func(line string) { eventLog.Info(line) },
+	}
+}
+
+func (l *eventLogger) log(event string, tapType zerodoc.TAPTypeEnum, aclGID uint16, writer *WrappedWriter, filename string, err error) {
+	if l == nil {
+		return
+	}
+	e := &Event{
+		Event:    event,
+		Worker:   l.index,
+		AclGID:   aclGID,
+		TapType:  l.tapTypeNames.String(tapType),
+		Filename: filename,
+	}
+	if writer != nil {
+		e.Packets = writer.packetCount
+		if writer.Writer != nil {
+			e.Bytes = writer.FileSize()
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Warningf("Marshal pcap event %s of %s failed: %s", event, filename, err)
+		return
+	}
+	l.output(string(line))
+}
@@ -17,13 +17,17 @@
 package pcap
 
 import (
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/deepflowio/deepflow/server/ingester/common"
@@ -33,23 +37,149 @@ import (
 )
 
 var (
-	EXAMPLE_TEMPNAME        = getTempFilename(zerodoc.CLOUD, 0, time.Duration(time.Now().UnixNano()), 0)
+	EXAMPLE_TEMPNAME        = getTempFilename(tapTypeToString(zerodoc.CLOUD), 0, "0", time.Duration(time.Now().UnixNano()), 0, "", 0)
 	EXAMPLE_TEMPNAME_SPLITS = len(strings.Split(EXAMPLE_TEMPNAME, "_"))
 )
 
+type Option = interface{}
+
+// rotation
+type OptionMaxPacketsPerFile int // rotate files after this many packets, 0 means unlimited
+type OptionIdleTimeoutSecond int // close files without new packets for this long, 0 means disabled
+type OptionRotationClock = RotationClock
+type OptionFlowByteBudgetKB int // packets are dropped after a file is given this many bytes until it's rotated, 0 means unlimited
+type OptionRingFiles int        // only the newest finished files of each writer key are kept, 0 means unlimited
+type OptionIdleBackoffTicks int // back off the expiry sweep after this many ticks without packets, 0 means disabled
+type OptionIdleBackoffMinMs int // sweep interval when backing off starts, IDLE_BACKOFF_MIN by default
+type OptionIdleBackoffMaxMs int // upper bound of the sweep interval, doubled after each sweep while idle
+
+// naming and layout
+type OptionNodeID string // prefix of the index segment in filenames, for storage shared by multiple nodes
+type OptionTapTypeNames = TapTypeNames
+type OptionFilenameFormatter func(writer *WrappedWriter, base string) string // generates .pcap filenames under base instead of DefaultFilenameFormatter
+type OptionTapTypeDirectory bool                                             // write files to <base>/<aclGID>/<tapType>/ instead of <base>/<aclGID>/
+
+// finishing files
+type OptionSyncOnClose bool                             // fsync files before renaming them to their final names
+type OptionEncryptionKey []byte                         // AES key to encrypt finished files with
+type OptionEncryptionKeyProvider func() ([]byte, error) // fetches the AES key from a KMS etc.
+type OptionExtraOutputFormats []OutputFormat            // each capture is also written in these formats, at most MAX_EXTRA_OUTPUT_FORMATS
+type OptionFlowSummary bool                             // write a JSON summary to <file>.json after each file is finalized
+type OptionOnFileFinalized func(*FileInfo)              // called asynchronously after a file is renamed to its final name
+type OptionStructuredLog bool                           // additionally log file lifecycle events as JSON to the pcap.event module
+type OptionRecoverTempFiles bool                        // append to valid temp files left by the last run instead of finishing them on start
+type OptionQuarantineOnWriteFailure bool                // close a capture on write failure and keep its temp file with QUARANTINE_SUFFIX
+
+// packets
+type OptionWriterKeyMode = WriterKeyMode
+type OptionRouteByWriterKey bool     // forward packets between workers so that each writer key is written by one worker
+type OptionMaxPacketSize int         // packets larger than this are truncated or dropped, 0 means SNAPLEN
+type OptionDropOversizedPackets bool // drop oversized packets instead of truncating them
+type OptionMinPacketSize int         // packets with shorter PacketLen are skipped, 0 means disabled
+type OptionMonotonicTimestamp bool   // clamp timestamps of out-of-order packets to the previous record in each file
+type OptionPacketsWithFCS bool       // Ethernet frames from the agents end with the FCS, which is stripped before writing
+type OptionDecapsulateTunnel bool    // write the inner frames of tunneled packets whose RawHeader contains the tunnel headers
+type OptionDryRun bool               // go through the whole capture path and update counters without touching the disk
+
+// limits on new files
+type OptionFileCreationRate int        // new files per second, rotations are not limited, 0 means unlimited
+type OptionFileCreationBurst int       // defaults to the rate
+type OptionMaxFilesPerAclGID int       // concurrent files of an aclGID in each worker, 0 means unlimited
+type OptionOverflowCapacity int        // packets held per worker when maxConcurrentFiles is reached, 0 means they are dropped
+type OptionCreateRetries int           // consecutive creation failures backed off, at most MAX_CREATE_RETRIES, 0 means no backoff
+type OptionCreateRetryBackoffMs int    // no file is created within it after a failure, doubled after each consecutive one
+type OptionMinFreeDiskSpaceMB int      // no file is created if free space of the base directory is less, 0 means disabled
+type OptionFailoverDirectory string    // new files go to it when free space of the base directory is below OptionMinFreeDiskSpaceMB
+type OptionOnNewDirectory func(string) // called when SetBaseDirectory switches to a directory, e.g. to have it cleaned by libs/pcap.Cleaner
+
+// queues and buffers
+type OptionQueueBatchSize int       // max elements read from the queue at a time, 1024 by default
+type OptionPacketQueueSize int      // size of the queues, forwarded blocks put into a full one are counted as overwrites
+type OptionCloseTimeoutSecond int   // Close stops waiting for workers to finish files after this long, 0 means waiting forever
+type OptionSlowWriteThresholdMs int // writes taking longer are counted as slow, 0 means disabled
+type OptionDropOnSlowWrite bool     // drop packets for a while after a slow write instead of blocking the queue on a stalled disk
+type OptionMinBlockSizeKB int       // lower bound of the adaptive buffer size, raised to hold a packet of snaplen
+type OptionMaxBlockSizeKB int       // buffer size of new files adapts to the throughput if larger than the lower bound
+
 type WorkerManager struct {
 	packetQueueReaders []queue.QueueReader
 	packetQueueWriters []queue.QueueWriter
 	workers            []*Worker
+	cancel             context.CancelFunc
+	queueBatchSize     int
+	packetQueueSize    int
 
 	tcpipChecksum         bool
 	blockSizeKB           int
+	minBlockSizeKB        int
+	maxBlockSizeKB        int
 	maxConcurrentFiles    int
 	maxFileSizeMB         int
 	maxFilePeriodSecond   int
 	maxDirectorySizeGB    int
 	diskFreeSpaceMarginGB int
 	baseDirectory         string
+	nextBaseDirectory     atomic.Value // the base of new files, may be changed by SetBaseDirectory
+	failoverDirectory     string
+	onNewDirectory        func(string)
+	tapTypeDirectory      bool
+	tapTypeNames          TapTypeNames
+
+	syncOnClose       bool
+	maxPacketsPerFile int
+	flowByteBudgetKB  int
+	ringFiles         int
+	nodeID            string
+	idleTimeoutSecond int
+	writerKeyMode     WriterKeyMode
+	rotationClock     RotationClock
+
+	getEncryptionKey func() ([]byte, error)
+	encryption       cipher.AEAD
+
+	dryRun bool
+
+	maxPacketSize        int
+	minPacketSize        int
+	dropOversizedPackets bool
+
+	onFileFinalized func(*FileInfo)
+	structuredLog   bool
+
+	filenameFormatter OptionFilenameFormatter
+	extraFormats      []OutputFormat
+
+	recoverTempFiles bool
+	recoverable      *recoverableFiles
+
+	fileCreationRate  int
+	fileCreationBurst int
+	creationLimiter   *tokenBucket // shared by workers
+	maxFilesPerAclGID int
+	overflowCapacity  int
+
+	slowWriteThresholdMs int
+	dropOnSlowWrite      bool
+	createRetries        int
+	createRetryBackoffMs int
+	minFreeDiskSpaceMB   int
+
+	closeTimeoutSecond int
+
+	quarantineOnWriteFailure bool
+	monotonicTimestamp       bool
+
+	decapsulateTunnel bool
+	packetsWithFCS    bool
+	routeByWriterKey  bool
+	flowSummary       bool
+
+	idleBackoffTicks int
+	idleBackoffMinMs int
+	idleBackoffMaxMs int
+
+	healthLock         sync.Mutex
+	lastHealthCounters []WorkerCounter
 }
 
 func NewWorkerManager(
@@ -63,11 +193,13 @@ func NewWorkerManager(
 	maxDirectorySizeGB int,
 	diskFreeSpaceMarginGB int,
 	baseDirectory string,
+	options ...Option,
 ) *WorkerManager {
-	return &WorkerManager{
+	m := &WorkerManager{
 		packetQueueReaders: packetQueueReaders,
 		packetQueueWriters: packetQueueWriters,
 		workers:            make([]*Worker, len(packetQueueReaders)),
+		queueBatchSize:     QUEUE_BATCH_SIZE,
 
 		tcpipChecksum:         tcpipChecksum,
 		blockSizeKB:           blockSizeKB,
@@ -77,22 +209,178 @@ func NewWorkerManager(
 		maxDirectorySizeGB:    maxDirectorySizeGB,
 		diskFreeSpaceMarginGB: diskFreeSpaceMarginGB,
 		baseDirectory:         baseDirectory,
+
+		createRetryBackoffMs: int(CREATE_RETRY_BACKOFF / time.Millisecond),
+		minPacketSize:        MIN_PACKET_SIZE,
+
+		idleBackoffMinMs: int(IDLE_BACKOFF_MIN / time.Millisecond),
+		idleBackoffMaxMs: int(IDLE_BACKOFF_MAX / time.Millisecond),
+	}
+	m.nextBaseDirectory.Store(baseDirectory)
+	for _, option := range options {
+		switch o := option.(type) {
+		case OptionSyncOnClose:
+			m.syncOnClose = bool(o)
+		case OptionMaxPacketsPerFile:
+			m.maxPacketsPerFile = int(o)
+		case OptionFlowByteBudgetKB:
+			m.flowByteBudgetKB = int(o)
+		case OptionRingFiles:
+			m.ringFiles = int(o)
+		case OptionNodeID:
+			m.nodeID = sanitizeNodeID(string(o))
+		case OptionIdleTimeoutSecond:
+			m.idleTimeoutSecond = int(o)
+		case OptionWriterKeyMode:
+			m.writerKeyMode = o
+		case OptionRotationClock:
+			m.rotationClock = o
+		case OptionEncryptionKey:
+			m.getEncryptionKey = func() ([]byte, error) { return o, nil }
+		case OptionEncryptionKeyProvider:
+			m.getEncryptionKey = o
+		case OptionDryRun:
+			m.dryRun = bool(o)
+		case OptionMaxPacketSize:
+			m.maxPacketSize = int(o)
+		case OptionMinPacketSize:
+			m.minPacketSize = int(o)
+		case OptionDropOversizedPackets:
+			m.dropOversizedPackets = bool(o)
+		case OptionOnFileFinalized:
+			m.onFileFinalized = o
+		case OptionStructuredLog:
+			m.structuredLog = bool(o)
+		case OptionFilenameFormatter:
+			m.filenameFormatter = o
+		case OptionQuarantineOnWriteFailure:
+			m.quarantineOnWriteFailure = bool(o)
+		case OptionMonotonicTimestamp:
+			m.monotonicTimestamp = bool(o)
+		case OptionDecapsulateTunnel:
+			m.decapsulateTunnel = bool(o)
+		case OptionPacketsWithFCS:
+			m.packetsWithFCS = bool(o)
+		case OptionRouteByWriterKey:
+			m.routeByWriterKey = bool(o)
+		case OptionMinFreeDiskSpaceMB:
+			m.minFreeDiskSpaceMB = int(o)
+		case OptionFailoverDirectory:
+			m.failoverDirectory = string(o)
+		case OptionOnNewDirectory:
+			m.onNewDirectory = o
+		case OptionMinBlockSizeKB:
+			m.minBlockSizeKB = int(o)
+		case OptionMaxBlockSizeKB:
+			m.maxBlockSizeKB = int(o)
+		case OptionCreateRetries:
+			if o > MAX_CREATE_RETRIES {
+				log.Warningf("pcap create retries %d exceeds the limit, use %d instead", o, MAX_CREATE_RETRIES)
+				o = MAX_CREATE_RETRIES
+			}
+			if o > 0 {
+				m.createRetries = int(o)
+			}
+		case OptionCreateRetryBackoffMs:
+			if o > MAX_CREATE_RETRY_BACKOFF_MS {
+				log.Warningf("pcap create retry backoff %dms exceeds the limit, use %dms instead", o, MAX_CREATE_RETRY_BACKOFF_MS)
+				o = MAX_CREATE_RETRY_BACKOFF_MS
+			}
+			if o > 0 {
+				m.createRetryBackoffMs = int(o)
+			}
+		case OptionExtraOutputFormats:
+			m.extraFormats = validateOutputFormats(o)
+		case OptionRecoverTempFiles:
+			m.recoverTempFiles = bool(o)
+		case OptionFileCreationRate:
+			m.fileCreationRate = int(o)
+		case OptionFileCreationBurst:
+			m.fileCreationBurst = int(o)
+		case OptionMaxFilesPerAclGID:
+			m.maxFilesPerAclGID = int(o)
+		case OptionOverflowCapacity:
+			m.overflowCapacity = int(o)
+		case OptionSlowWriteThresholdMs:
+			m.slowWriteThresholdMs = int(o)
+		case OptionDropOnSlowWrite:
+			m.dropOnSlowWrite = bool(o)
+		case OptionTapTypeDirectory:
+			m.tapTypeDirectory = bool(o)
+		case OptionTapTypeNames:
+			m.tapTypeNames = validateTapTypeNames(o)
+		case OptionFlowSummary:
+			m.flowSummary = bool(o)
+		case OptionIdleBackoffTicks:
+			m.idleBackoffTicks = int(o)
+		case OptionIdleBackoffMinMs:
+			if o > 0 {
+				m.idleBackoffMinMs = int(o)
+			}
+		case OptionIdleBackoffMaxMs:
+			if o > 0 {
+				m.idleBackoffMaxMs = int(o)
+			}
+		case OptionCloseTimeoutSecond:
+			m.closeTimeoutSecond = int(o)
+		case OptionQueueBatchSize:
+			if o <= 0 || o > queue.MAX_BATCH_GET_SIZE {
+				log.Warningf("invalid pcap queue batch size %d, use %d instead", o, QUEUE_BATCH_SIZE)
+				continue
+			}
+			m.queueBatchSize = int(o)
+		case OptionPacketQueueSize:
+			m.packetQueueSize = int(o)
+		}
+	}
+	if m.idleBackoffMaxMs < m.idleBackoffMinMs {
+		m.idleBackoffMaxMs = m.idleBackoffMinMs
 	}
+	if m.fileCreationRate > 0 {
+		// 所有worker共用一个令牌桶，总速率不超过配置
+		m.creationLimiter = newTokenBucket(m.fileCreationRate, m.fileCreationBurst)
+	}
+	return m
 }
 
 func (m *WorkerManager) Start() []io.Closer {
-	os.MkdirAll(m.baseDirectory, os.ModePerm)
+	return m.StartContext(context.Background())
+}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go markAndCleanTempFiles(m.baseDirectory, wg)
-	wg.Wait()
+// StartContext starts the workers which also exit if ctx is canceled, workers
+// blocked on empty queues notice it on the next tick
+func (m *WorkerManager) StartContext(ctx context.Context) []io.Closer {
+	if m.getEncryptionKey != nil {
+		var err error
+		if m.encryption, err = newEncryptionCipher(m.getEncryptionKey); err != nil {
+			// 宁可不存储也不能写明文
+			log.Errorf("Pcap encryption is enabled but the cipher is unavailable, pcap storage is not started: %s", err)
+			return nil
+		}
+	}
+	if m.dryRun {
+		log.Infof("Pcap storage runs in dry-run mode, no file will be written")
+	} else {
+		directories := m.directories()
+		for _, directory := range directories {
+			os.MkdirAll(directory, os.ModePerm)
+		}
+
+		if m.recoverTempFiles {
+			m.recoverable = loadRecoverableFiles(directories)
+		}
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go markAndCleanTempFiles(directories, m.encryption, m.syncOnClose, m.filenameFormatter != nil, m.recoverable, wg)
+		wg.Wait()
+	}
 
+	ctx, m.cancel = context.WithCancel(ctx)
 	for i := 0; i < len(m.packetQueueReaders); i++ {
 		worker := m.newWorker(queue.HashKey(i))
 		m.workers[i] = worker
 		common.RegisterCountableForIngester("pcap", worker, stats.OptionStatTags{"index": strconv.Itoa(i)})
-		go worker.Process()
+		go worker.ProcessContext(ctx)
 	}
 	return []io.Closer{m}
 }
@@ -100,11 +388,16 @@ func (m *WorkerManager) Start() []io.Closer {
 func (m *WorkerManager) Close() error {
 	wg := sync.WaitGroup{}
 	wg.Add(len(m.workers))
-	for _, w := range m.workers {
-		go func(worker *Worker, waitGroup *sync.WaitGroup) {
-			worker.Close()
+	errs := make([]error, len(m.workers))
+	for i, w := range m.workers {
+		go func(index int, worker *Worker, waitGroup *sync.WaitGroup) {
+			errs[index] = worker.Close()
 			waitGroup.Done()
-		}(w, &wg)
+		}(i, w, &wg)
+	}
+	if m.cancel != nil {
+		// 不等待当前批次处理完
+		m.cancel()
 	}
 	time.Sleep(time.Second)
 	for i := range m.workers {
@@ -113,9 +406,61 @@ func (m *WorkerManager) Close() error {
 		m.packetQueueWriters[i].Put(nil)
 	}
 	wg.Wait()
+	var firstErr error
+	for _, err := range errs {
+		if err != nil {
+			log.Warning(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// BaseDirectory returns the base directory of new files
+func (m *WorkerManager) BaseDirectory() string {
+	return m.nextBaseDirectory.Load().(string)
+}
+
+// directories returns the directories temp files may be left in by the last run
+func (m *WorkerManager) directories() []string {
+	if m.failoverDirectory == "" || m.failoverDirectory == m.baseDirectory {
+		return []string{m.baseDirectory}
+	}
+	return []string{m.baseDirectory, m.failoverDirectory}
+}
+
+// SetBaseDirectory switches new files to directory, e.g. for failover to another
+// volume, and reports it to OptionOnNewDirectory. Files being written are still
+// finished in the former base directory. Temp files are cleaned or recovered at
+// Start only in the configured base and failover directories.
+func (m *WorkerManager) SetBaseDirectory(directory string) error {
+	if !m.dryRun {
+		if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+			return fmt.Errorf("create pcap base directory %s failed: %s", directory, err)
+		}
+	}
+	if previous := m.nextBaseDirectory.Swap(directory); previous != directory {
+		log.Infof("Pcap base directory is changed from %s to %s", previous, directory)
+		if m.onNewDirectory != nil {
+			m.onNewDirectory(directory)
+		}
+	}
 	return nil
 }
 
+// sanitizeNodeID keeps only characters which can't break filename parsing,
+// i.e. '_' and '.' used as segment separators are replaced
+func sanitizeNodeID(nodeID string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, nodeID)
+}
+
 func findLastRecordTime(file string) time.Duration {
 	fp, err := os.Open(file)
 	if err != nil {
@@ -152,14 +497,23 @@ func isTempFilename(name string) bool {
 	return strings.HasSuffix(name, ".pcap.temp") && len(strings.Split(name, "_")) == EXAMPLE_TEMPNAME_SPLITS
 }
 
-func markAndCleanTempFiles(baseDirectory string, scanWg *sync.WaitGroup) {
+// files with custom names are only recognized by TEMP_SUFFIX, and finished by removing it
+func markAndCleanTempFiles(directories []string, encryption cipher.AEAD, syncOnClose, customFilename bool, recoverable *recoverableFiles, scanWg *sync.WaitGroup) {
 	var files []string
-	filepath.Walk(baseDirectory, func(path string, info os.FileInfo, err error) error {
+	walkDirectories(directories, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		name := info.Name()
-		if info.IsDir() || !isTempFilename(name) {
+		if !info.IsDir() && strings.HasSuffix(name, ENCRYPTED_SUFFIX+ENCRYPTING_SUFFIX) {
+			// 加密中断，明文临时文件仍在，会被再次加密
+			os.Remove(path)
+			return nil
+		}
+		if info.IsDir() || !(isTempFilename(name) || customFilename && strings.HasSuffix(name, TEMP_SUFFIX)) {
+			return nil
+		}
+		if recoverable.contains(path) {
 			return nil
 		}
 		files = append(files, path)
@@ -175,8 +529,34 @@ func markAndCleanTempFiles(baseDirectory string, scanWg *sync.WaitGroup) {
 			os.Remove(path)
 			continue
 		}
+		finishTempFile(path, lastPacketTime, encryption, syncOnClose)
+	}
+}
+
+// walkDirectories walks each of directories, an error only stops walking the
+// directory it occurs in
+func walkDirectories(directories []string, walkFn filepath.WalkFunc) {
+	for _, directory := range directories {
+		filepath.Walk(directory, walkFn)
+	}
+}
+
+// finishTempFile renames a temp file left by the last run to its final name
+func finishTempFile(path string, lastPacketTime time.Duration, encryption cipher.AEAD, syncOnClose bool) {
+	var newFilename string
+	if isTempFilename(filepath.Base(path)) {
 		firstDotIndex := strings.IndexByte(path, '.')
-		newFilename := path[:firstDotIndex] + formatDuration(lastPacketTime) + path[firstDotIndex:strings.Index(path, ".temp")]
-		os.Rename(path, newFilename)
+		newFilename = path[:firstDotIndex] + formatDuration(lastPacketTime) + path[firstDotIndex:strings.Index(path, ".temp")]
+	} else {
+		newFilename = strings.TrimSuffix(path, TEMP_SUFFIX)
+	}
+	if encryption != nil {
+		if err := encryptTempFile(encryption, path, newFilename, syncOnClose); err != nil {
+			log.Warningf("Failed to encrypt %s: %s", path, err)
+		}
+		return
+	}
+	if err := renameFile(path, newFilename); err != nil {
+		log.Warningf("Failed to rename %s to %s: %s", path, newFilename, err)
 	}
 }
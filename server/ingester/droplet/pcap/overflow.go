@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"sync/atomic"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+// overflowEntry holds a copy of a packet, since its block is released after
+// processing
+type overflowEntry struct {
+	packet   datatype.MetaPacket
+	tapType  zerodoc.TAPTypeEnum
+	aclGID   uint16
+	linkType layers.LinkType
+	buffer   []byte // backing array of the slices in packet, reused by later entries
+}
+
+func (e *overflowEntry) copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	start := len(e.buffer)
+	e.buffer = append(e.buffer, b...)
+	return e.buffer[start:len(e.buffer):len(e.buffer)]
+}
+
+func (e *overflowEntry) set(packet *datatype.MetaPacket, tapType zerodoc.TAPTypeEnum, aclGID uint16, linkType layers.LinkType) {
+	e.buffer = e.buffer[:0]
+	e.packet = *packet
+	e.packet.RawHeader = e.copyBytes(packet.RawHeader)
+	e.packet.RawIcmp = e.copyBytes(packet.RawIcmp)
+	e.packet.Ip6Src = e.copyBytes(packet.Ip6Src)
+	e.packet.Ip6Dst = e.copyBytes(packet.Ip6Dst)
+	e.packet.Options = e.copyBytes(packet.Options)
+	e.packet.TcpData.Sack = e.copyBytes(packet.TcpData.Sack)
+	// 以下字段在写入时不再使用，且可能引用已释放的内存
+	e.packet.EndpointData = datatype.EndpointData{}
+	e.packet.PolicyData = datatype.PolicyData{}
+	e.packet.Tunnel = nil
+	e.tapType, e.aclGID, e.linkType = tapType, aclGID, linkType
+}
+
+// overflowRing holds packets of new writer keys in arrival order while the
+// worker has maxConcurrentFiles open, they are written after files finish
+type overflowRing struct {
+	entries []overflowEntry
+	head    int
+	count   int
+
+	draining bool
+	blocked  bool // the packet being drained still needs a free file slot
+}
+
+func newOverflowRing(capacity int) *overflowRing {
+	return &overflowRing{entries: make([]overflowEntry, capacity)}
+}
+
+func (r *overflowRing) at(i int) *overflowEntry {
+	return &r.entries[(r.head+i)%len(r.entries)]
+}
+
+// holdPacket is called instead of creating a writer when maxConcurrentFiles is reached
+func (w *Worker) holdPacket(packet *datatype.MetaPacket, tapType zerodoc.TAPTypeEnum, aclGID uint16, linkType layers.LinkType) {
+	r := w.overflow
+	if r.draining {
+		r.blocked = true
+		return
+	}
+	if r.count == len(r.entries) {
+		atomic.AddUint64(&w.OverflowDrops, 1)
+		return
+	}
+	r.at(r.count).set(packet, tapType, aclGID, linkType)
+	r.count++
+	atomic.AddUint64(&w.OverflowPackets, 1)
+}
+
+// drainOverflow writes the held packets in order after files are finished.
+// Packets still without a free file slot are kept in order, so are those of the
+// same writer key, while packets of writer keys opened by former ones are
+// written.
+func (w *Worker) drainOverflow() {
+	r := w.overflow
+	if r == nil || r.count == 0 {
+		return
+	}
+	r.draining = true
+	kept := 0
+	for i := 0; i < r.count; i++ {
+		entry := r.at(i)
+		r.blocked = false
+		w.writeToWriter(&entry.packet, entry.tapType, entry.aclGID, entry.linkType)
+		if r.blocked {
+			// 交换而不是复制，保留各entry的缓冲区
+			*r.at(kept), *entry = *entry, *r.at(kept)
+			kept++
+		}
+	}
+	r.count = kept
+	r.draining = false
+}
+
+// dropOverflow counts packets still held when the worker exits
+func (w *Worker) dropOverflow() {
+	if r := w.overflow; r != nil && r.count > 0 {
+		log.Warningf("Drop %d packets held in the overflow ring of pcap worker (%d)", r.count, w.index)
+		atomic.AddUint64(&w.OverflowDrops, uint64(r.count))
+		r.count = 0
+	}
+}
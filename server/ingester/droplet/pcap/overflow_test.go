@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestOverflowRing(t *testing.T) {
+	w := newTestWorker(t, OptionOverflowCapacity(2))
+	w.maxConcurrentFiles = 1
+	w.writePacket(newRawPacket(1*time.Second, 64), zerodoc.CLOUD, 1)
+	held := newRawPacket(2*time.Second, 64)
+	w.writePacket(held, zerodoc.CLOUD, 2)
+	// 暂存的包是副本，不受原始包释放后复用的影响
+	held.RawHeader[0] = 0xff
+	w.writePacket(newRawPacket(3*time.Second, 64), zerodoc.CLOUD, 3)
+	w.writePacket(newRawPacket(4*time.Second, 64), zerodoc.CLOUD, 4)
+	w.writePacket(newRawPacket(5*time.Second, 64), zerodoc.CLOUD, 1)
+	if w.OverflowPackets != 2 || w.OverflowDrops != 1 || w.FileRejections != 0 {
+		t.Fatalf("expected 2 held and 1 dropped, got %d and %d", w.OverflowPackets, w.OverflowDrops)
+	}
+
+	// 每结束一个文件写入一个暂存的新文件，其余的包继续按顺序等待
+	w.cleanTimeoutFile(time.Hour)
+	if w.overflow.count != 1 || w.WriterCount() != 1 || len(w.writers[zerodoc.CLOUD]) != 1 {
+		t.Fatalf("expected 1 packet held and 1 file open, got %d and %d", w.overflow.count, w.WriterCount())
+	}
+	w.cleanTimeoutFile(time.Hour)
+	w.cleanTimeoutFile(time.Hour)
+	if w.overflow.count != 0 || w.WriterCount() != 0 {
+		t.Fatalf("expected all packets written, got %d held", w.overflow.count)
+	}
+
+	for aclGID, count := range map[string]int{"1": 2, "2": 1, "3": 1, "4": 0} {
+		files, _ := filepath.Glob(filepath.Join(w.baseDirectory, aclGID, "*.pcap"))
+		if count == 0 {
+			if len(files) != 0 {
+				t.Errorf("unexpected files of aclGID %s: %v", aclGID, files)
+			}
+			continue
+		}
+		if len(files) != 1 {
+			t.Fatalf("expected 1 file of aclGID %s, got %v", aclGID, files)
+		}
+		records, err := readAll(t, files[0])
+		if err != nil || len(records) != count {
+			t.Fatalf("expected %d records of aclGID %s, got %d: %v", count, aclGID, len(records), err)
+		}
+		if records[0].Data[0] != 0 {
+			t.Errorf("record of aclGID %s is modified", aclGID)
+		}
+	}
+}
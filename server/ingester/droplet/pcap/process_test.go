@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+)
+
+func TestQueueBatchSize(t *testing.T) {
+	if w := newTestWorker(t); w.queueBatchSize != QUEUE_BATCH_SIZE {
+		t.Errorf("expected default batch size %d, got %d", QUEUE_BATCH_SIZE, w.queueBatchSize)
+	}
+	if w := newTestWorker(t, OptionQueueBatchSize(64)); w.queueBatchSize != 64 {
+		t.Errorf("expected batch size 64, got %d", w.queueBatchSize)
+	}
+	for _, size := range []int{0, -1, queue.MAX_BATCH_GET_SIZE + 1} {
+		if w := newTestWorker(t, OptionQueueBatchSize(size)); w.queueBatchSize != QUEUE_BATCH_SIZE {
+			t.Errorf("invalid batch size %d should be ignored, got %d", size, w.queueBatchSize)
+		}
+	}
+}
+
+func benchmarkProcess(b *testing.B, batchSize int) {
+	const queueSize = 1 << 14
+	q := queue.NewOverwriteQueue("pcap_benchmark", queueSize)
+	m := NewWorkerManager([]queue.QueueReader{q}, []queue.QueueWriter{q}, false, 64, 1000, 25, 300, 100, 10, b.TempDir(), OptionDryRun(true), OptionQueueBatchSize(batchSize))
+	w := m.newWorker(0)
+	m.workers[0] = w
+	go w.Process()
+	packet := newPolicyPacket(time.Second, 64, 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 避免覆盖队列中未处理的数据
+		for q.Len() > queueSize/2 {
+			runtime.Gosched()
+		}
+		block := datatype.AcquireMetaPacketBlock()
+		for j := range block.Metas {
+			block.Metas[j] = *packet
+		}
+		block.Count = datatype.META_PACKET_SIZE_PER_BLOCK
+		q.Put(block)
+	}
+	// 文件头也计入BufferedCount
+	for w.Snapshot().BufferedCount < uint64(b.N*datatype.META_PACKET_SIZE_PER_BLOCK)+1 {
+		runtime.Gosched()
+	}
+	b.StopTimer()
+	m.Close()
+	q.Close()
+}
+
+func BenchmarkProcessBatch16(b *testing.B) {
+	benchmarkProcess(b, 16)
+}
+
+func BenchmarkProcessBatch256(b *testing.B) {
+	benchmarkProcess(b, 256)
+}
+
+func BenchmarkProcessBatch1024(b *testing.B) {
+	benchmarkProcess(b, 1024)
+}
+
+func BenchmarkProcessBatch4096(b *testing.B) {
+	benchmarkProcess(b, 4096)
+}
+
+// chanQueue delivers one element at a time for tests that run Process
+type chanQueue chan interface{}
+
+func (q chanQueue) Get() interface{} {
+	return <-q
+}
+
+func (q chanQueue) Gets(output []interface{}) int {
+	output[0] = <-q
+	return 1
+}
+
+func (q chanQueue) Put(items ...interface{}) error {
+	for _, item := range items {
+		q <- item
+	}
+	return nil
+}
+
+func (q chanQueue) Len() int {
+	return 0
+}
+
+func (q chanQueue) Close() error {
+	return nil
+}
+
+func TestCloseTimeout(t *testing.T) {
+	q := make(chanQueue)
+	m := NewWorkerManager([]queue.QueueReader{q}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir())
+	w := m.newWorker(0)
+	w.closeTimeout = 100 * time.Millisecond
+	go w.Process()
+
+	// 持有锁模拟Process阻塞在写文件
+	w.writersLock.Lock()
+	block := datatype.AcquireMetaPacketBlock()
+	block.Metas[0] = *newPolicyPacket(time.Second, 64, 1)
+	block.Count = 1
+	q <- block
+
+	start := time.Now()
+	if err := w.Close(); err == nil {
+		t.Error("Close should fail if the worker doesn't exit")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close should return after the timeout, took %s", elapsed)
+	}
+	if !w.Stuck() || w.Closed() {
+		t.Error("worker should be marked as stuck")
+	}
+
+	// exiting已设置，处理完当前数据后Process即退出
+	w.writersLock.Unlock()
+	<-w.stopped
+	if w.WriterCount() != 0 {
+		t.Errorf("files should be finished after the worker exits, got %d", w.WriterCount())
+	}
+}
+
+func TestProcessContext(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	w := newTestWorker(t)
+	block := datatype.AcquireMetaPacketBlock()
+	block.Metas[0] = *newPolicyPacket(time.Second, 64, 1)
+	block.Count = 1
+	if w.processBlock(block, done) || w.FileCreations != 0 {
+		t.Error("no packet should be processed after cancellation")
+	}
+	if block.Count != 0 {
+		t.Error("block should be released")
+	}
+	block = datatype.AcquireMetaPacketBlock()
+	block.Count = 1
+	if releaseElements([]interface{}{nil, block}); block.Count != 0 {
+		t.Error("remaining blocks in the batch should be released")
+	}
+
+	q := make(chanQueue)
+	m := NewWorkerManager([]queue.QueueReader{q}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir())
+	w = m.newWorker(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	go w.ProcessContext(ctx)
+	block = datatype.AcquireMetaPacketBlock()
+	block.Metas[0] = *newPolicyPacket(time.Second, 64, 1)
+	block.Count = 1
+	q <- block
+	cancel()
+	q <- nil
+	<-w.stopped
+	if !w.Closed() || w.WriterCount() != 0 {
+		t.Errorf("worker should exit with all files finished, got %d files", w.WriterCount())
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	ErrTruncatedRecord = errors.New("truncated pcap record")
+	ErrCorruptRecord   = errors.New("corrupt pcap record")
+)
+
+type Record struct {
+	Timestamp time.Duration
+	OrigLen   int
+	Data      []byte
+}
+
+// Reader parses the files written by Writer, i.e. classic little-endian pcap
+type Reader struct {
+	reader   *bufio.Reader
+	fp       *os.File
+	snaplen  int
+	linkType layers.LinkType
+
+	header [RECORD_HEADER_LEN]byte
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{reader: bufio.NewReader(r)}
+	header := make(GlobalHeader, GLOBAL_HEADER_LEN)
+	if _, err := io.ReadFull(reader.reader, header); err != nil {
+		return nil, fmt.Errorf("read pcap global header failed: %s", err)
+	}
+	if header.Magic() != PCAP_MAGIC {
+		return nil, fmt.Errorf("unsupported pcap magic 0x%x", header.Magic())
+	}
+	reader.snaplen = int(header.Snaplen())
+	reader.linkType = header.LinkType()
+	return reader, nil
+}
+
+func OpenReader(filename string) (*Reader, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewReader(fp)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	reader.fp = fp
+	return reader, nil
+}
+
+// Next returns io.EOF after the last complete record. Records returned before
+// ErrTruncatedRecord or ErrCorruptRecord are still valid, usually the file was
+// not closed properly.
+func (r *Reader) Next() (*Record, error) {
+	n, err := io.ReadFull(r.reader, r.header[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: record header has only %d bytes", ErrTruncatedRecord, n)
+	}
+	header := RecordHeader(r.header[:])
+	inclLen, origLen := header.InclLen(), header.OrigLen()
+	if inclLen > r.snaplen || inclLen > origLen {
+		return nil, fmt.Errorf("%w: incl_len %d, orig_len %d, snaplen %d", ErrCorruptRecord, inclLen, origLen, r.snaplen)
+	}
+	record := &Record{
+		Timestamp: header.Timestamp(),
+		OrigLen:   origLen,
+		Data:      make([]byte, inclLen),
+	}
+	if n, err := io.ReadFull(r.reader, record.Data); err != nil {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrTruncatedRecord, inclLen, n)
+	}
+	return record, nil
+}
+
+func (r *Reader) Snaplen() int {
+	return r.snaplen
+}
+
+func (r *Reader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+func (r *Reader) Close() error {
+	if r.fp == nil {
+		return nil
+	}
+	return r.fp.Close()
+}
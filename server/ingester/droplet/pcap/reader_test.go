@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func readAll(t *testing.T, filename string) ([]*Record, error) {
+	reader, err := OpenReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("unexpected link type %s", reader.LinkType())
+	}
+	var records []*Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	w := newTestWorker(t)
+	var packets [][]byte
+	for i := 0; i < 10; i++ {
+		packet := newRawPacket(time.Second+time.Duration(i)*time.Millisecond, 60+i)
+		packets = append(packets, packet.RawHeader)
+		w.writePacket(packet, zerodoc.CLOUD, 1)
+	}
+	w.cleanTimeoutFile(time.Hour)
+
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %v", files)
+	}
+	records, err := readAll(t, files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(packets) {
+		t.Fatalf("expected %d records, got %d", len(packets), len(records))
+	}
+	for i, record := range records {
+		if record.Timestamp != time.Second+time.Duration(i)*time.Millisecond || record.OrigLen != len(packets[i]) || !bytes.Equal(record.Data, packets[i]) {
+			t.Errorf("record %d does not match the packet written", i)
+		}
+	}
+}
+
+func TestReaderTruncatedFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "truncated.pcap")
+	writer, err := NewWriter(filename, 1<<16, SNAPLEN, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(newRawPacket(time.Second, 100))
+	writer.Write(newRawPacket(time.Second, 100))
+	writer.Close()
+
+	size := GLOBAL_HEADER_LEN + 2*(RECORD_HEADER_LEN+100)
+	for _, truncated := range []int{size - 50, size - 100 - RECORD_HEADER_LEN/2} {
+		os.Truncate(filename, int64(truncated))
+		records, err := readAll(t, filename)
+		if len(records) != 1 || !errors.Is(err, ErrTruncatedRecord) {
+			t.Errorf("expected 1 record and ErrTruncatedRecord at size %d, got %d and %v", truncated, len(records), err)
+		}
+	}
+
+	if _, err := NewReader(bytes.NewReader(make([]byte, GLOBAL_HEADER_LEN))); err == nil {
+		t.Error("file without pcap magic should be rejected")
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// recoverableFile is a temp file left by the last run which can be appended to
+type recoverableFile struct {
+	tempFilename    string
+	firstPacketTime time.Duration
+	lastPacketTime  time.Duration
+	packetCount     uint64
+	sequence        int
+	snaplen         int
+	linkType        layers.LinkType
+}
+
+type recoverableFiles struct {
+	sync.Mutex
+	files map[string]*recoverableFile
+}
+
+// recoveryKey is the temp filename without firstPacketTime, which is the same
+// for the files of a writer before and after restart
+func recoveryKey(tempFilename string) string {
+	fields := strings.Split(filepath.Base(tempFilename), "_")
+	if len(fields) != EXAMPLE_TEMPNAME_SPLITS {
+		return ""
+	}
+	fields[3] = ""
+	return filepath.Join(filepath.Dir(tempFilename), strings.Join(fields, "_"))
+}
+
+// tempFileSequence returns the sequence after firstPacketTime in tempFilename
+func tempFileSequence(tempFilename string) int {
+	fields := strings.Split(filepath.Base(tempFilename), "_")
+	if len(fields) != EXAMPLE_TEMPNAME_SPLITS {
+		return 0
+	}
+	index := strings.IndexByte(fields[3], '-')
+	if index < 0 {
+		return 0
+	}
+	sequence, _ := strconv.Atoi(fields[3][index+1:])
+	return sequence
+}
+
+// validateTempFile checks the pcap header and all records of a temp file, a
+// partial or corrupt record and everything after it are truncated
+func validateTempFile(filename string) (*recoverableFile, error) {
+	reader, err := OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	file := &recoverableFile{tempFilename: filename, sequence: tempFileSequence(filename), snaplen: reader.Snaplen(), linkType: reader.LinkType()}
+	offset := int64(GLOBAL_HEADER_LEN)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Infof("Truncate %s to %d bytes: %s", filename, offset, err)
+			if err := os.Truncate(filename, offset); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if file.packetCount == 0 {
+			file.firstPacketTime = record.Timestamp
+		}
+		file.lastPacketTime = record.Timestamp
+		file.packetCount++
+		offset += int64(RECORD_HEADER_LEN + len(record.Data))
+	}
+	if file.packetCount == 0 {
+		return nil, errors.New("no valid record")
+	}
+	return file, nil
+}
+
+// loadRecoverableFiles validates the temp files with default names under
+// directories, invalid ones are removed
+func loadRecoverableFiles(directories []string) *recoverableFiles {
+	r := &recoverableFiles{files: make(map[string]*recoverableFile)}
+	walkDirectories(directories, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isTempFilename(info.Name()) {
+			return nil
+		}
+		file, err := validateTempFile(path)
+		if err != nil {
+			log.Warningf("Remove unrecoverable temp file %s: %s", path, err)
+			os.Remove(path)
+			return nil
+		}
+		r.files[recoveryKey(path)] = file
+		return nil
+	})
+	log.Infof("Found %d recoverable pcap temp files", len(r.files))
+	return r
+}
+
+func (r *recoverableFiles) contains(path string) bool {
+	if r == nil {
+		return false
+	}
+	r.Lock()
+	file, ok := r.files[recoveryKey(path)]
+	r.Unlock()
+	return ok && file.tempFilename == path
+}
+
+func (r *recoverableFiles) take(key string) *recoverableFile {
+	r.Lock()
+	defer r.Unlock()
+	file := r.files[key]
+	delete(r.files, key)
+	return file
+}
+
+// takeExpired returns files not taken by any writer within maxFilePeriod
+func (r *recoverableFiles) takeExpired(timeNow, maxFilePeriod time.Duration) []*recoverableFile {
+	r.Lock()
+	defer r.Unlock()
+	var expired []*recoverableFile
+	for key, file := range r.files {
+		if timeNow-file.firstPacketTime > maxFilePeriod {
+			expired = append(expired, file)
+			delete(r.files, key)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+// crash leaves the temp files of all writers as if the process is killed
+func crash(w *Worker) []string {
+	var files []string
+	for _, writer := range w.writers[zerodoc.CLOUD] {
+		writer.Close()
+		files = append(files, writer.tempFilename)
+	}
+	return files
+}
+
+func restart(t *testing.T, baseDirectory string) *Worker {
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, baseDirectory, OptionRecoverTempFiles(true))
+	m.recoverable = loadRecoverableFiles([]string{baseDirectory})
+	return m.newWorker(0)
+}
+
+func TestRecoverTempFile(t *testing.T) {
+	w := newTestWorker(t)
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(2*time.Second, 100), zerodoc.CLOUD, 1)
+	files := crash(w)
+	// 模拟写了一半的包
+	fp, _ := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0644)
+	fp.Write(make([]byte, RECORD_HEADER_LEN-6))
+	fp.Close()
+
+	w = restart(t, w.baseDirectory)
+	w.writePacket(newRawPacket(3*time.Second, 100), zerodoc.CLOUD, 1)
+	if w.RecoveredFiles != 1 || w.FileCreations != 0 {
+		t.Fatalf("expected the temp file to be recovered, got %d recovered and %d created", w.RecoveredFiles, w.FileCreations)
+	}
+	w.cleanTimeoutFile(time.Hour)
+
+	finished, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if len(finished) != 1 {
+		t.Fatalf("expected 1 finished file, got %v", finished)
+	}
+	records, err := readAll(t, finished[0])
+	if err != nil || len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d %v", len(records), err)
+	}
+	if records[0].Timestamp != time.Second || records[2].Timestamp != 3*time.Second {
+		t.Errorf("unexpected records %v", records)
+	}
+}
+
+func TestRecoverInvalidTempFile(t *testing.T) {
+	w := newTestWorker(t)
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 2)
+	files := crash(w)
+	os.WriteFile(files[0], make([]byte, GLOBAL_HEADER_LEN), 0644)
+
+	w = restart(t, w.baseDirectory)
+	if len(w.recoverable.files) != 1 {
+		t.Fatalf("expected 1 recoverable file, got %d", len(w.recoverable.files))
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Error("corrupt temp file should be removed")
+	}
+
+	// 超过文件周期仍未被使用的临时文件直接结束
+	w.cleanTimeoutFile(time.Hour)
+	if len(w.recoverable.files) != 0 {
+		t.Error("expired recoverable file should be finished")
+	}
+	finished, _ := filepath.Glob(filepath.Join(w.baseDirectory, "*", "*.pcap"))
+	if len(finished) != 1 {
+		t.Errorf("expected 1 finished file, got %v", finished)
+	}
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/utils"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+// ReplayInfo is recovered from the path generated by WrappedWriter.getFilename
+type ReplayInfo struct {
+	TapType zerodoc.TAPTypeEnum
+	TapPort uint32
+	AclGID  uint16
+	VtapId  uint16
+	Format  string // name of the extra OutputFormat, empty for the main file
+}
+
+func errInvalidTapType(s string) error {
+	return fmt.Errorf("invalid tap type %s", s)
+}
+
+func stringToTapType(s string) (zerodoc.TAPTypeEnum, error) {
+	if s == "tor" {
+		return zerodoc.CLOUD, nil
+	}
+	if !strings.HasPrefix(s, "isp") {
+		return 0, errInvalidTapType(s)
+	}
+	tapType, err := strconv.ParseUint(s[len("isp"):], 10, 8)
+	return zerodoc.TAPTypeEnum(tapType), err
+}
+
+// 格式为 <base>/<aclGID>/<tapType>_<tapPort>_<flowName>_<firstPacketTime>_<lastPacketTime>.<index>.pcap,
+// 开启OptionTapTypeDirectory时aclGID目录下还有一层<tapType>目录
+// 额外格式的文件名为 ...<index>.<format>.pcap
+// tapTypeNames is what the file is written with, nil for the default names
+func ParseFilename(filename string, tapTypeNames TapTypeNames) (*ReplayInfo, error) {
+	base := filepath.Base(filename)
+	segments := strings.Split(base, ".")
+	format := ""
+	if len(segments) == 4 { // 额外格式的文件
+		format = segments[2]
+		segments = append(segments[:2], segments[3])
+	}
+	if len(segments) != 3 || segments[2] != "pcap" {
+		return nil, fmt.Errorf("%s is not a finished pcap file", base)
+	}
+	fields := strings.Split(segments[0], "_")
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid pcap filename %s", base)
+	}
+
+	info := &ReplayInfo{Format: format}
+	var err error
+	if info.TapType, err = tapTypeNames.Parse(fields[0]); err != nil {
+		return nil, fmt.Errorf("invalid pcap filename %s: %s", base, err)
+	}
+	tapPort, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tap port in pcap filename %s: %s", base, err)
+	}
+	info.TapPort = uint32(tapPort)
+	index := segments[1][strings.LastIndexByte(segments[1], '-')+1:] // 去掉nodeID前缀
+	vtapId, err := strconv.ParseUint(index, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index in pcap filename %s: %s", base, err)
+	}
+	info.VtapId = uint16(vtapId)
+	directory := filepath.Dir(filename)
+	if filepath.Base(directory) == fields[0] {
+		directory = filepath.Dir(directory)
+	}
+	aclGID, err := strconv.ParseUint(filepath.Base(directory), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid acl gid directory of %s: %s", filename, err)
+	}
+	info.AclGID = uint16(aclGID)
+	return info, nil
+}
+
+type packetDecoder struct {
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	tcp     layers.TCP
+	udp     layers.UDP
+	parser  *gopacket.DecodingLayerParser
+	parser4 *gopacket.DecodingLayerParser // LinkTypeRaw
+	parser6 *gopacket.DecodingLayerParser // LinkTypeRaw
+	decoded []gopacket.LayerType
+}
+
+func newPacketDecoder() *packetDecoder {
+	d := &packetDecoder{}
+	decoders := []gopacket.DecodingLayer{&d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.udp}
+	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, decoders...)
+	d.parser4 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, decoders...)
+	d.parser6 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, decoders...)
+	for _, parser := range []*gopacket.DecodingLayerParser{d.parser, d.parser4, d.parser6} {
+		parser.IgnoreUnsupported = true
+	}
+	return d
+}
+
+// decode fills the L2-L4 fields of packet from its RawHeader, undecodable
+// layers are left empty
+func (d *packetDecoder) decode(packet *datatype.MetaPacket, linkType layers.LinkType) {
+	parser := d.parser
+	if linkType == layers.LinkTypeRaw && len(packet.RawHeader) > 0 {
+		parser = d.parser4
+		if packet.RawHeader[0]>>4 == 6 {
+			parser = d.parser6
+		}
+	}
+	d.decoded = d.decoded[:0]
+	parser.DecodeLayers(packet.RawHeader, &d.decoded)
+	for _, layerType := range d.decoded {
+		switch layerType {
+		case layers.LayerTypeEthernet:
+			packet.MacSrc = datatype.MacIntFromBytes(d.eth.SrcMAC)
+			packet.MacDst = datatype.MacIntFromBytes(d.eth.DstMAC)
+			packet.EthType = d.eth.EthernetType
+		case layers.LayerTypeDot1Q:
+			packet.Vlan = d.dot1q.VLANIdentifier
+			packet.EthType = d.dot1q.Type
+		case layers.LayerTypeIPv4:
+			packet.EthType = layers.EthernetTypeIPv4
+			packet.IpSrc = utils.IpToUint32(d.ip4.SrcIP.To4())
+			packet.IpDst = utils.IpToUint32(d.ip4.DstIP.To4())
+			packet.Protocol = d.ip4.Protocol
+			packet.TTL = d.ip4.TTL
+			packet.IpID = d.ip4.Id
+		case layers.LayerTypeIPv6:
+			packet.EthType = layers.EthernetTypeIPv6
+			packet.Ip6Src = append(packet.Ip6Src[:0], d.ip6.SrcIP...)
+			packet.Ip6Dst = append(packet.Ip6Dst[:0], d.ip6.DstIP...)
+			packet.Protocol = d.ip6.NextHeader
+			packet.NextHeader = d.ip6.NextHeader
+			packet.TTL = d.ip6.HopLimit
+		case layers.LayerTypeTCP:
+			packet.PortSrc = uint16(d.tcp.SrcPort)
+			packet.PortDst = uint16(d.tcp.DstPort)
+			packet.TcpData.Flags = tcpFlags(&d.tcp)
+			packet.TcpData.Seq = d.tcp.Seq
+			packet.TcpData.Ack = d.tcp.Ack
+			packet.TcpData.DataOffset = d.tcp.DataOffset
+			packet.TcpData.WinSize = d.tcp.Window
+			fillTCPOptions(&packet.TcpData, d.tcp.Options)
+		case layers.LayerTypeUDP:
+			packet.PortSrc = uint16(d.udp.SrcPort)
+			packet.PortDst = uint16(d.udp.DstPort)
+		}
+	}
+}
+
+// tcpFlags returns the flags in the byte order of the TCP header
+func tcpFlags(tcp *layers.TCP) uint8 {
+	var flags uint8
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			flags |= 1 << i
+		}
+	}
+	return flags
+}
+
+// fillTCPOptions fills the options MetaPacket keeps, i.e. what the converter writes
+func fillTCPOptions(tcpData *datatype.MetaPacketTcpHeader, options []layers.TCPOption) {
+	tcpData.MSS, tcpData.WinScale, tcpData.SACKPermitted = 0, 0, false
+	for _, option := range options {
+		switch option.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(option.OptionData) == 2 {
+				tcpData.MSS = binary.BigEndian.Uint16(option.OptionData)
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(option.OptionData) == 1 {
+				tcpData.WinScale = option.OptionData[0]
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			tcpData.SACKPermitted = true
+		}
+	}
+}
+
+// Replay puts the packets of a finished pcap file into out as MetaPacketBlocks.
+// If realtime is set, the original inter-packet gaps are kept, otherwise packets
+// are replayed as fast as possible. Returns the number of packets replayed.
+// tapTypeNames is what the file is written with, nil for the default names.
+// Only what's in the file and its name is restored, EndpointData and PolicyData
+// are left empty, so the packets have to be labeled again to match policies.
+func Replay(filename string, tapTypeNames TapTypeNames, out queue.MultiQueueWriter, key queue.HashKey, realtime bool) (int, error) {
+	info, err := ParseFilename(filename, tapTypeNames)
+	if err != nil {
+		return 0, err
+	}
+	reader, err := OpenReader(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	decoder := newPacketDecoder()
+	block := datatype.AcquireMetaPacketBlock()
+	count := 0
+	var lastTimestamp time.Duration
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			if block.Count > 0 {
+				out.Put(key, block)
+			} else {
+				datatype.ReleaseMetaPacketBlock(block)
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			return count, err
+		}
+		if realtime && count > 0 && record.Timestamp > lastTimestamp {
+			if block.Count > 0 {
+				out.Put(key, block)
+				block = datatype.AcquireMetaPacketBlock()
+			}
+			time.Sleep(record.Timestamp - lastTimestamp)
+		}
+		lastTimestamp = record.Timestamp
+
+		packet := &block.Metas[block.Count]
+		packet.Timestamp = record.Timestamp
+		packet.RawHeader = record.Data
+		packet.RawHeaderSize = uint16(len(record.Data))
+		packet.PacketLen = uint16(record.OrigLen)
+		packet.TapType = datatype.TapType(info.TapType)
+		packet.TapPort = info.TapPort
+		packet.VtapId = info.VtapId
+		packet.QueueHash = uint8(key)
+		decoder.decode(packet, reader.LinkType())
+		block.Count++
+		count++
+		if block.Count == datatype.META_PACKET_SIZE_PER_BLOCK {
+			out.Put(key, block)
+			block = datatype.AcquireMetaPacketBlock()
+		}
+	}
+}
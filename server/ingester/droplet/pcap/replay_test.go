@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func newUdpPacket(t *testing.T, timestamp time.Duration, srcPort uint16) *datatype.MetaPacket {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, eth, ip, udp, gopacket.Payload("replay")); err != nil {
+		t.Fatal(err)
+	}
+	raw := buffer.Bytes()
+	return &datatype.MetaPacket{
+		RawHeader:     raw,
+		RawHeaderSize: uint16(len(raw)),
+		PacketLen:     uint16(len(raw)),
+		Timestamp:     timestamp,
+		TapPort:       0x1234,
+		VtapId:        7,
+	}
+}
+
+func TestParseFilename(t *testing.T) {
+	writer := &WrappedWriter{tapType: 5, tapPort: 0xabcdef, aclGID: 12, vtapId: 345, nodeID: "node-1", flowName: "0"}
+	info, err := ParseFilename(writer.getFilename("/base"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *info != (ReplayInfo{TapType: 5, TapPort: 0xabcdef, AclGID: 12, VtapId: 345}) {
+		t.Errorf("unexpected replay info %+v", info)
+	}
+	if _, err := ParseFilename("/base/12/tor_000000000000_0_700101000000_.00001.pcap.temp", nil); err == nil {
+		t.Error("temp file should not be parsed")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	w := newTestWorker(t)
+	for i := 0; i < datatype.META_PACKET_SIZE_PER_BLOCK+1; i++ {
+		w.writePacket(newUdpPacket(t, time.Second+time.Duration(i)*time.Millisecond, uint16(1000+i)), zerodoc.CLOUD, 1)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %v", files)
+	}
+
+	out := queue.NewOverwriteQueues("pcap_replay_test", 1, 16)
+	if n, err := Replay(files[0], nil, out, 0, false); err != nil || n != datatype.META_PACKET_SIZE_PER_BLOCK+1 {
+		t.Fatalf("expected %d packets replayed, got %d %v", datatype.META_PACKET_SIZE_PER_BLOCK+1, n, err)
+	}
+	if out.Len(0) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", out.Len(0))
+	}
+	block := out.Get(0).(*datatype.MetaPacketBlock)
+	packet := &block.Metas[1]
+	expected := newUdpPacket(t, time.Second+time.Millisecond, 1001)
+	if packet.Timestamp != expected.Timestamp || !bytes.Equal(packet.RawHeader, expected.RawHeader) || packet.PacketLen != expected.PacketLen {
+		t.Errorf("replayed packet does not match the captured one")
+	}
+	if packet.TapType != datatype.TAP_CLOUD || packet.TapPort != 0x1234 || packet.VtapId != 7 {
+		t.Errorf("unexpected tap info %d %x %d", packet.TapType, packet.TapPort, packet.VtapId)
+	}
+	if packet.EthType != layers.EthernetTypeIPv4 || packet.IpSrc != 0x0a000001 || packet.IpDst != 0x0a000002 ||
+		packet.Protocol != layers.IPProtocolUDP || packet.PortSrc != 1001 || packet.PortDst != 53 {
+		t.Errorf("packet headers not decoded: %s", packet)
+	}
+	if block = out.Get(0).(*datatype.MetaPacketBlock); block.Count != 1 {
+		t.Errorf("expected 1 packet in the last block, got %d", block.Count)
+	}
+}
+
+func TestReplayRawIP(t *testing.T) {
+	w := newTestWorker(t)
+	packet := newUdpPacket(t, time.Second, 1000)
+	packet.RawHeader = packet.RawHeader[14:] // strip the ethernet header
+	packet.RawHeaderSize -= 14
+	packet.PacketLen -= 14
+	packet.EthType = layers.EthernetTypeIPv4
+	w.writePacket(packet, zerodoc.CLOUD, 1)
+	w.writePacket(newUdpPacket(t, 2*time.Second, 1000), zerodoc.CLOUD, 1)
+	if w.FileCreations != 2 {
+		t.Fatalf("changing link type should rotate the file")
+	}
+	w.cleanTimeoutFile(time.Hour)
+
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	linkTypes := map[layers.LinkType]bool{}
+	for _, file := range files {
+		reader, err := OpenReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		linkTypes[reader.LinkType()] = true
+		reader.Close()
+
+		out := queue.NewOverwriteQueues("pcap_replay_raw_test", 1, 16)
+		if n, err := Replay(file, nil, out, 0, false); err != nil || n != 1 {
+			t.Fatalf("expected 1 packet replayed, got %d %v", n, err)
+		}
+		replayed := &out.Get(0).(*datatype.MetaPacketBlock).Metas[0]
+		if replayed.IpSrc != 0x0a000001 || replayed.PortSrc != 1000 || replayed.PortDst != 53 {
+			t.Errorf("packet headers not decoded from %s: %s", file, replayed)
+		}
+	}
+	if !linkTypes[layers.LinkTypeRaw] || !linkTypes[layers.LinkTypeEthernet] {
+		t.Errorf("expected both raw and ethernet files, got %v", linkTypes)
+	}
+}
+
+func TestReplayTCP(t *testing.T) {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 1000, DstPort: 80, Seq: 100, SYN: true, ECE: true, Window: 1024, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+	}}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	raw := buffer.Bytes()
+
+	// 使用自定义采集点名称写入的文件需要同样的名称才能回放
+	w := newTestWorker(t, OptionTapTypeNames{3: "cloud"})
+	w.writePacket(&datatype.MetaPacket{RawHeader: raw, RawHeaderSize: uint16(len(raw)), PacketLen: uint16(len(raw)), Timestamp: time.Second}, zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "cloud_*.pcap"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %v", files)
+	}
+	out := queue.NewOverwriteQueues("pcap_replay_tcp_test", 1, 16)
+	if _, err := Replay(files[0], nil, out, 0, false); err == nil {
+		t.Error("custom tap type names should not be replayed with the default ones")
+	}
+	if n, err := Replay(files[0], w.tapTypeNames, out, 0, false); err != nil || n != 1 {
+		t.Fatalf("expected 1 packet replayed, got %d %v", n, err)
+	}
+	packet := &out.Get(0).(*datatype.MetaPacketBlock).Metas[0]
+	expected := datatype.MetaPacketTcpHeader{Seq: 100, WinSize: 1024, MSS: 1460, Flags: 0x42, DataOffset: 8, WinScale: 7, SACKPermitted: true}
+	if packet.TapType != datatype.TAP_CLOUD || packet.TcpData.Seq != expected.Seq || packet.TcpData.WinSize != expected.WinSize ||
+		packet.TcpData.MSS != expected.MSS || packet.TcpData.Flags != expected.Flags || packet.TcpData.DataOffset != expected.DataOffset ||
+		packet.TcpData.WinScale != expected.WinScale || packet.TcpData.SACKPermitted != expected.SACKPermitted {
+		t.Errorf("tcp header not decoded, expected %v, got %v", &expected, &packet.TcpData)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ring holds the finished files of a writer key from the oldest
+type ring struct {
+	files          []string
+	lastPacketTime time.Duration
+}
+
+// getRingKey identifies the finished files of the same writer key, which only
+// differ in packet times
+func (w *WrappedWriter) getRingKey(base string) string {
+	return fmt.Sprintf("%s/%s_%s_%s.%s", w.getDirectory(base), w.tapTypeNames.String(w.tapType), tapPortToMacString(w.tapPort), w.flowName, formatIndex(w.nodeID, w.vtapId))
+}
+
+// getRingPattern matches the finished files of the same writer key
+func (w *WrappedWriter) getRingPattern(base string, encrypted bool) string {
+	pattern := fmt.Sprintf("%s/%s_%s_%s_*_*.%s.pcap",
+		escapeGlob(w.getDirectory(base)), escapeGlob(w.tapTypeNames.String(w.tapType)), tapPortToMacString(w.tapPort), escapeGlob(w.flowName), escapeGlob(formatIndex(w.nodeID, w.vtapId)))
+	if encrypted {
+		pattern += ENCRYPTED_SUFFIX
+	}
+	return pattern
+}
+
+// escapeGlob makes s match itself in filepath.Match patterns
+func escapeGlob(s string) string {
+	if !strings.ContainsAny(s, `*?[\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// sortByTime sorts finished files of a writer key by their first packet times,
+// in which the sequence of files rotated within a second is padded, as "_"
+// sorts after "-" and a file without sequence is the first of its second
+func sortByTime(files []string) {
+	keys := make(map[string]string, len(files))
+	for _, file := range files {
+		fields := strings.Split(filepath.Base(file), "_")
+		if len(fields) > 3 && !strings.Contains(fields[3], "-") {
+			fields[3] += "-000"
+		}
+		keys[file] = strings.Join(fields, "_")
+	}
+	sort.Slice(files, func(i, j int) bool { return keys[files[i]] < keys[files[j]] })
+}
+
+// trimRing keeps the newest ringFiles finished files of the writer key, older
+// ones are removed together with their extra formats and summaries. Rings are
+// remembered per writer key, and loaded from the directory the first time a key
+// is finished after start or pruning, so that files left by the last run are
+// also trimmed.
+func (w *Worker) trimRing(writer *WrappedWriter, filename string) {
+	if w.ringFiles <= 0 || w.dryRun || writer.customFilename {
+		return
+	}
+	w.ringsLock.Lock()
+	defer w.ringsLock.Unlock()
+	if w.rings == nil {
+		w.rings = make(map[string]*ring)
+	}
+	key := writer.getRingKey(writer.baseDirectory)
+	r := w.rings[key]
+	if r == nil {
+		r = &ring{}
+		files, err := filepath.Glob(writer.getRingPattern(writer.baseDirectory, w.encryption != nil))
+		if err != nil {
+			log.Debugf("Failed to load ring of %s: %s", filename, err)
+			files = []string{filename}
+		}
+		sortByTime(files)
+		r.files = files
+		w.rings[key] = r
+	} else {
+		r.files = append(r.files, filename)
+	}
+	r.lastPacketTime = writer.lastPacketTime
+	if len(r.files) <= w.ringFiles {
+		return
+	}
+	evicted := len(r.files) - w.ringFiles
+	for _, file := range r.files[:evicted] {
+		if err := os.Remove(file); err != nil {
+			log.Debugf("Failed to remove %s from ring: %s", file, err)
+			continue
+		}
+		os.Remove(file + SUMMARY_SUFFIX)
+		plain := strings.TrimSuffix(file, ENCRYPTED_SUFFIX)
+		for _, format := range w.extraFormats {
+			os.Remove(withFormat(plain, format.Name) + file[len(plain):])
+		}
+		atomic.AddUint64(&w.RingEvictions, 1)
+	}
+	r.files = append(r.files[:0], r.files[evicted:]...)
+}
+
+// pruneRings forgets rings with no file finished for RING_IDLE_PERIODS file
+// periods, checked once per file period. They're loaded again if needed.
+func (w *Worker) pruneRings(timeNow time.Duration) {
+	w.ringsLock.Lock()
+	defer w.ringsLock.Unlock()
+	if len(w.rings) == 0 || timeNow-w.ringPruneTime < w.maxFilePeriod {
+		return
+	}
+	w.ringPruneTime = timeNow
+	for key, r := range w.rings {
+		if timeNow-r.lastPacketTime > RING_IDLE_PERIODS*w.maxFilePeriod {
+			delete(w.rings, key)
+		}
+	}
+}
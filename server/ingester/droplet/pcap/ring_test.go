@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestRingFiles(t *testing.T) {
+	w := newTestWorker(t, OptionRingFiles(2), OptionExtraOutputFormats{{Name: "hdr", Snaplen: 200}})
+	var times []time.Duration
+	for i := 0; i < 4; i++ {
+		timestamp := time.Duration(i)*(w.maxFilePeriod+time.Second) + time.Second
+		times = append(times, timestamp)
+		w.writePacket(newRawPacket(timestamp, 64), zerodoc.CLOUD, 1)
+	}
+	// 其它writer key的文件不受影响
+	other := newRawPacket(time.Second, 64)
+	other.TapPort = 1
+	w.writePacket(other, zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour * 24)
+
+	if w.RingEvictions != 2 {
+		t.Errorf("expected 2 evictions, got %d", w.RingEvictions)
+	}
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*_000000000000_*.00000.pcap"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files in the ring, got %v", files)
+	}
+	for i, file := range files {
+		if first := formatDuration(times[i+2]); !strings.Contains(file, "_"+first+"_") {
+			t.Errorf("expected the newest files to be kept, got %s", file)
+		}
+	}
+	if extra, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*_000000000000_*.hdr.pcap")); len(extra) != 2 {
+		t.Errorf("extra formats should be evicted together, got %v", extra)
+	}
+	if others, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*_000000000001_*.00000.pcap")); len(others) != 1 {
+		t.Errorf("files of other writer keys should be kept, got %v", others)
+	}
+}
+
+func TestRingAcrossRestart(t *testing.T) {
+	// 目录名中的通配符不能影响匹配
+	base := filepath.Join(t.TempDir(), "pcap[1]*")
+	writeFiles := func(w *Worker, from, count int) {
+		for i := from; i < from+count; i++ {
+			w.writePacket(newRawPacket(time.Duration(i)*(w.maxFilePeriod+time.Second)+time.Second, 64), zerodoc.CLOUD, 1)
+		}
+		w.cleanTimeoutFile(time.Duration(from+count)*(w.maxFilePeriod+time.Second) + time.Second)
+	}
+	newWorker := func() *Worker {
+		m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, base, OptionRingFiles(2))
+		return m.newWorker(0)
+	}
+
+	w := newWorker()
+	writeFiles(w, 0, 2)
+	if len(w.rings) != 1 {
+		t.Fatalf("expected 1 ring, got %d", len(w.rings))
+	}
+	// 重启后首次结束文件时从目录加载之前的文件
+	w = newWorker()
+	writeFiles(w, 2, 2)
+	if w.RingEvictions != 2 {
+		t.Errorf("expected 2 evictions, got %d", w.RingEvictions)
+	}
+	files, _ := os.ReadDir(filepath.Join(base, "1"))
+	if len(files) != 2 {
+		t.Errorf("expected 2 files in the ring, got %d", len(files))
+	}
+}
+
+func TestPruneRings(t *testing.T) {
+	w := newTestWorker(t, OptionRingFiles(2))
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(w.maxFilePeriod + 2*time.Second)
+	if len(w.rings) != 1 {
+		t.Fatalf("expected 1 ring, got %d", len(w.rings))
+	}
+	w.cleanTimeoutFile(RING_IDLE_PERIODS*w.maxFilePeriod + 2*time.Second)
+	if len(w.rings) != 0 {
+		t.Errorf("idle ring should be pruned, got %d rings", len(w.rings))
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	for _, s := range []string{"abc", "a*b", "a?[b]", `a\b`} {
+		if matched, err := filepath.Match(escapeGlob(s), s); !matched || err != nil {
+			t.Errorf("%q doesn't match itself after escaped: %v", s, err)
+		}
+	}
+	if matched, _ := filepath.Match(escapeGlob("a*"), "ab"); matched {
+		t.Error("escaped wildcard should not match other characters")
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestMaxPacketsPerFile(t *testing.T) {
+	w := newTestWorker(t, OptionMaxPacketsPerFile(2))
+	for i := 0; i < 5; i++ {
+		w.writePacket(newRawPacket(time.Duration(i)*time.Millisecond, 64), zerodoc.CLOUD, 1)
+	}
+	if w.FileCreations != 3 || w.FileCloses != 2 {
+		t.Errorf("expected 3 creations and 2 closes, got %d and %d", w.FileCreations, w.FileCloses)
+	}
+	for _, writer := range w.writers[zerodoc.CLOUD] {
+		if writer.packetCount != 1 {
+			t.Errorf("packet count of rotated writer should restart, got %d", writer.packetCount)
+		}
+	}
+	// 同一秒内轮转的文件不能互相覆盖
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 3 || packets != 5 {
+		t.Errorf("expected 5 packets in 3 files, got %d in %d", packets, files)
+	}
+}
+
+func TestRotationWithinSecond(t *testing.T) {
+	raw := func(timestamp time.Duration) *datatype.MetaPacket {
+		packet := newRawPacket(timestamp, 64)
+		packet.EthType = layers.EthernetTypeIPv4
+		packet.RawHeader[0] = 0x45
+		return packet
+	}
+	w := newTestWorker(t, OptionMaxPacketsPerFile(2))
+	// 包数、linktype变化、哈希冲突触发的轮转都在同一秒内
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second+time.Millisecond, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second+2*time.Millisecond, 64), zerodoc.CLOUD, 1)
+	w.writePacket(raw(time.Second+3*time.Millisecond), zerodoc.CLOUD, 1)
+	for _, writer := range w.writers[zerodoc.CLOUD] {
+		writer.flow.port0++ // 模拟不同的流哈希到同一个key
+	}
+	w.writePacket(raw(time.Second+4*time.Millisecond), zerodoc.CLOUD, 1)
+	// 下一秒的文件重新从0编号
+	w.writePacket(raw(2*time.Second), zerodoc.CLOUD, 1)
+	w.writePacket(raw(2*time.Second), zerodoc.CLOUD, 1)
+	w.writePacket(raw(2*time.Second), zerodoc.CLOUD, 1)
+	if w.FileCreations != 5 {
+		t.Fatalf("expected 5 files, got %d", w.FileCreations)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	sortByTime(files)
+	second, next := formatDuration(time.Second), formatDuration(2*time.Second)
+	for i, first := range []string{second, second + "-001", second + "-002", second + "-003", next} {
+		if i >= len(files) || !strings.Contains(filepath.Base(files[i]), "_"+first+"_") {
+			t.Errorf("expected file %d to start at %s, got %v", i, first, files)
+		}
+	}
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 5 || packets != 8 {
+		t.Errorf("expected 8 packets in 5 files, got %d in %d", packets, files)
+	}
+}
+
+func TestFilenameIndex(t *testing.T) {
+	writer := &WrappedWriter{tapType: zerodoc.CLOUD, aclGID: 1, vtapId: 12, flowName: "0"}
+	if name := writer.getFilename("/base"); name != "/base/1/tor_000000000000_0_700101000000_700101000000.00012.pcap" {
+		t.Errorf("unexpected filename %s", name)
+	}
+	if !(formatIndex("", 9) < formatIndex("", 10) && formatIndex("", 10) < formatIndex("", 100)) {
+		t.Error("indexes should sort lexicographically")
+	}
+
+	writer.nodeID = sanitizeNodeID("node_1.a")
+	if writer.nodeID != "node-1-a" {
+		t.Errorf("unexpected sanitized node id %s", writer.nodeID)
+	}
+	if name := writer.getTempFilename("/base"); !isTempFilename(name[len("/base/1/"):]) {
+		t.Errorf("temp filename %s with node id is not recognized", name)
+	}
+	writer.sequence = 2
+	if name := writer.getTempFilename("/base"); !isTempFilename(name[len("/base/1/"):]) || tempFileSequence(name) != 2 {
+		t.Errorf("temp filename %s with sequence is not recognized", name)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	w := newTestWorker(t, OptionIdleTimeoutSecond(10))
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 2)
+	w.writePacket(newRawPacket(8*time.Second, 64), zerodoc.CLOUD, 2)
+
+	w.cleanTimeoutFile(15 * time.Second)
+	if w.IdleCloses != 1 || len(w.writers[zerodoc.CLOUD]) != 1 {
+		t.Errorf("expected the idle writer to be closed, got %d idle closes and %d writers", w.IdleCloses, len(w.writers[zerodoc.CLOUD]))
+	}
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "*", "*.pcap")); files != 1 || packets != 1 {
+		t.Errorf("expected only the file of aclGID 1 finished, got %d files and %d packets", files, packets)
+	}
+	w.cleanTimeoutFile(20 * time.Second)
+	if w.IdleCloses != 2 || w.FileCloses != 2 {
+		t.Errorf("expected all writers to be closed, got %d idle closes", w.IdleCloses)
+	}
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "2", "*.pcap")); files != 1 || packets != 2 {
+		t.Errorf("expected 2 packets in the file of aclGID 2, got %d files and %d packets", files, packets)
+	}
+}
+
+func TestFlowByteBudget(t *testing.T) {
+	w := newTestWorker(t, OptionFlowByteBudgetKB(1))
+	for i := 0; i < 3; i++ {
+		w.writePacket(newRawPacket(time.Second, 500), zerodoc.CLOUD, 1)
+	}
+	if w.FlowBudgetDrops != 1 || w.FileCreations != 1 {
+		t.Errorf("expected 1 drop without rotation, got %d drops and %d files", w.FlowBudgetDrops, w.FileCreations)
+	}
+	// 正常轮转后重新计算预算
+	w.writePacket(newRawPacket(time.Second+w.maxFilePeriod+time.Second, 500), zerodoc.CLOUD, 1)
+	if w.FlowBudgetDrops != 1 || w.FileCreations != 2 {
+		t.Errorf("budget should be reset by rotation, got %d drops and %d files", w.FlowBudgetDrops, w.FileCreations)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 2 || packets != 3 {
+		t.Errorf("expected 3 packets in 2 files, got %d packets in %d files", packets, files)
+	}
+}
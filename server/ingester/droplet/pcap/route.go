@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"sync/atomic"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+// routedBlock is a block forwarded to another worker with the backing array
+// of the NpbActions of its packets
+type routedBlock struct {
+	block   *datatype.MetaPacketBlock
+	actions *[datatype.META_PACKET_SIZE_PER_BLOCK]datatype.NpbActions
+}
+
+// router forwards packets to the worker owning their writer keys, so that all
+// packets of a writer key are written to one file no matter which queue they
+// arrive in. It's only used by the worker owning it.
+type router struct {
+	queues    []queue.QueueWriter
+	queueSize int // 0 if unknown, overwrites are not counted then
+
+	pending  []routedBlock                                               // blocks being filled for each worker
+	ready    [][]routedBlock                                             // full blocks not sent to each worker yet
+	inflight [][]routedBlock                                             // blocks sent to each worker in order, referenced until the worker releases them
+	scratch  []*[datatype.META_PACKET_SIZE_PER_BLOCK]datatype.NpbActions // arrays of released blocks, reclaimed when none is left
+}
+
+func newRouter(queues []queue.QueueWriter, queueSize int) *router {
+	// OverwriteQueue会将大小向上取整为2的幂
+	if queueSize > 0 {
+		size := 1
+		for size < queueSize {
+			size <<= 1
+		}
+		queueSize = size
+	}
+	return &router{
+		queues:    queues,
+		queueSize: queueSize,
+		pending:   make([]routedBlock, len(queues)),
+		ready:     make([][]routedBlock, len(queues)),
+		inflight:  make([][]routedBlock, len(queues)),
+	}
+}
+
+// owner returns the index of the worker writing key of tapType
+func (r *router) owner(tapType zerodoc.TAPTypeEnum, key WriterKey) int {
+	hash := (uint64(key) ^ uint64(tapType)<<56) * 0x9e3779b97f4a7c15
+	return int((hash >> 32) % uint64(len(r.queues)))
+}
+
+// forward copies packet with only the policy to the block pending for owner,
+// it's called under writersLock so full blocks are sent by flushAll
+func (r *router) forward(owner int, packet *datatype.MetaPacket, policy datatype.NpbActions) {
+	routed := &r.pending[owner]
+	if routed.block == nil {
+		routed.block = datatype.AcquireMetaPacketBlock()
+		if len(r.scratch) == 0 {
+			for i := range r.inflight {
+				r.reclaim(i)
+			}
+		}
+		if n := len(r.scratch); n > 0 {
+			routed.actions = r.scratch[n-1]
+			r.scratch = r.scratch[:n-1]
+		} else {
+			routed.actions = new([datatype.META_PACKET_SIZE_PER_BLOCK]datatype.NpbActions)
+		}
+	}
+	block := routed.block
+	i := block.Count
+	meta := &block.Metas[i]
+	*meta = *packet
+	// 只保留转发的策略，避免接收方重复写入其它策略
+	routed.actions[i] = policy
+	meta.PolicyData.NpbActions = routed.actions[i : i+1 : i+1]
+	block.Count++
+	if block.Count == datatype.META_PACKET_SIZE_PER_BLOCK {
+		r.ready[owner] = append(r.ready[owner], *routed)
+		*routed = routedBlock{}
+	}
+}
+
+// send returns true if the queue of owner is full and its oldest block is
+// overwritten
+func (r *router) send(owner int, routed routedBlock) bool {
+	// 多持有一个引用，接收方或队列覆盖时释放后，数组才可以复用
+	routed.block.AddReferenceCount()
+	overwritten := r.queueSize > 0 && r.queues[owner].Len() >= r.queueSize
+	r.queues[owner].Put(routed.block)
+	r.inflight[owner] = append(r.inflight[owner], routed)
+	return overwritten
+}
+
+// reclaim takes back the arrays of blocks released by owner, which consumes
+// or overwrites them in order
+func (r *router) reclaim(owner int) {
+	inflight := r.inflight[owner]
+	n := 0
+	for ; n < len(inflight) && inflight[n].block.GetReferenceCount() == 1; n++ {
+		datatype.ReleaseMetaPacketBlock(inflight[n].block)
+		r.scratch = append(r.scratch, inflight[n].actions)
+		inflight[n] = routedBlock{}
+	}
+	if n == len(inflight) {
+		r.inflight[owner] = inflight[:0]
+	} else if n > 0 {
+		r.inflight[owner] = append(inflight[:0], inflight[n:]...)
+	}
+}
+
+// flushAll is called after each block out of writersLock, so forwarded packets
+// are delayed by no more than one block. It returns the number of blocks
+// overwritten in the queues.
+func (r *router) flushAll() (overwrites uint64) {
+	for owner := range r.queues {
+		for i, routed := range r.ready[owner] {
+			if r.send(owner, routed) {
+				overwrites++
+			}
+			r.ready[owner][i] = routedBlock{}
+		}
+		r.ready[owner] = r.ready[owner][:0]
+		if routed := r.pending[owner]; routed.block != nil {
+			if r.send(owner, routed) {
+				overwrites++
+			}
+			r.pending[owner] = routedBlock{}
+		}
+	}
+	return
+}
+
+// routePacket returns false if the packet of policy is forwarded to another worker
+func (w *Worker) routePacket(packet *datatype.MetaPacket, tapType zerodoc.TAPTypeEnum, policy datatype.NpbActions) bool {
+	if w.router == nil {
+		return true
+	}
+	key, _ := w.getWriterKey(packet, policy.TunnelGid())
+	owner := w.router.owner(tapType, key)
+	if owner == w.index {
+		return true
+	}
+	w.router.forward(owner, packet, policy)
+	atomic.AddUint64(&w.ForwardedPackets, 1)
+	return false
+}
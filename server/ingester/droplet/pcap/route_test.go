@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestRouteByWriterKey(t *testing.T) {
+	queues := []chanQueue{make(chanQueue, 16), make(chanQueue, 16)}
+	m := NewWorkerManager([]queue.QueueReader{queues[0], queues[1]}, []queue.QueueWriter{queues[0], queues[1]}, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionRouteByWriterKey(true))
+	workers := []*Worker{m.newWorker(0), m.newWorker(1)}
+
+	// 同一个writer key的包从两个队列进入
+	const policies = 8
+	for i := range workers {
+		block := datatype.AcquireMetaPacketBlock()
+		for aclGID := 1; aclGID <= policies; aclGID++ {
+			block.Metas[block.Count] = *newPolicyPacket(time.Second, 64, uint32(aclGID))
+			block.Count++
+		}
+		workers[i].processBlock(block, nil)
+	}
+	for i, q := range queues {
+		for len(q) > 0 {
+			workers[i].processBlock((<-q).(*datatype.MetaPacketBlock), nil)
+		}
+	}
+
+	if workers[0].ForwardedPackets+workers[1].ForwardedPackets != policies {
+		t.Errorf("expected %d forwarded packets, got %d and %d", policies, workers[0].ForwardedPackets, workers[1].ForwardedPackets)
+	}
+	files := 0
+	for i, w := range workers {
+		for _, writer := range w.writers[zerodoc.CLOUD] {
+			if writer.packetCount != 2 {
+				t.Errorf("packets of aclGID %d should be written by one worker, got %d", writer.aclGID, writer.packetCount)
+			}
+			if owner := w.router.owner(zerodoc.CLOUD, getWriterKey(0, 0, writer.aclGID)); owner != i {
+				t.Errorf("aclGID %d is written by worker %d instead of %d", writer.aclGID, i, owner)
+			}
+			files++
+		}
+	}
+	if files != policies {
+		t.Errorf("expected %d files, got %d", policies, files)
+	}
+	for _, w := range workers {
+		w.cleanTimeoutFile(time.Hour)
+	}
+	for aclGID := 1; aclGID <= policies; aclGID++ {
+		if files, packets := countPackets(t, filepath.Join(m.baseDirectory, strconv.Itoa(aclGID), "*.pcap")); files != 1 || packets != 2 {
+			t.Errorf("expected 2 packets of aclGID %d in 1 file, got %d packets in %d files", aclGID, packets, files)
+		}
+	}
+}
+
+func TestRouteReuseScratch(t *testing.T) {
+	queues := []chanQueue{make(chanQueue, 16), make(chanQueue, 16)}
+	m := NewWorkerManager([]queue.QueueReader{queues[0], queues[1]}, []queue.QueueWriter{queues[0], queues[1]}, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionRouteByWriterKey(true))
+	w, receiver := m.newWorker(0), m.newWorker(1)
+
+	var aclGID uint32 = 1
+	for w.router.owner(zerodoc.CLOUD, getWriterKey(0, 0, uint16(aclGID))) != 1 {
+		aclGID++
+	}
+	block := datatype.AcquireMetaPacketBlock()
+	block.Metas[0] = *newPolicyPacket(time.Second, 64, aclGID)
+	block.Count = 1
+	w.processBlock(block, nil)
+	forwarded := (<-queues[1]).(*datatype.MetaPacketBlock)
+	actions := w.router.inflight[1][0].actions
+	if &forwarded.Metas[0].PolicyData.NpbActions[0] != &actions[0] {
+		t.Fatal("forwarded policy should be in the scratch array")
+	}
+	receiver.processBlock(forwarded, nil)
+
+	// 接收方释放后，下一个块复用同一个数组
+	block = datatype.AcquireMetaPacketBlock()
+	block.Metas[0] = *newPolicyPacket(2*time.Second, 64, aclGID)
+	block.Count = 1
+	w.processBlock(block, nil)
+	forwarded = (<-queues[1]).(*datatype.MetaPacketBlock)
+	if w.router.inflight[1][0].actions != actions || &forwarded.Metas[0].PolicyData.NpbActions[0] != &actions[0] {
+		t.Error("scratch array should be reused after the receiver releases the block")
+	}
+	if policy := forwarded.Metas[0].PolicyData.NpbActions; len(policy) != 1 || policy[0].TunnelGid() != uint16(aclGID) {
+		t.Errorf("expected the policy of aclGID %d, got %v", aclGID, policy)
+	}
+	receiver.processBlock(forwarded, nil)
+	if w.ForwardedPackets != 2 || receiver.writers[zerodoc.CLOUD][getWriterKey(0, 0, uint16(aclGID))].packetCount != 2 {
+		t.Errorf("expected 2 packets forwarded and written, got %d", w.ForwardedPackets)
+	}
+}
+
+func TestRouteCountOverwrites(t *testing.T) {
+	release := queue.OptionRelease(func(x interface{}) { datatype.ReleaseMetaPacketBlock(x.(*datatype.MetaPacketBlock)) })
+	queues := []*queue.OverwriteQueue{queue.NewOverwriteQueue("pcap-route-test-0", 2, release), queue.NewOverwriteQueue("pcap-route-test-1", 2, release)}
+	m := NewWorkerManager([]queue.QueueReader{queues[0], queues[1]}, []queue.QueueWriter{queues[0], queues[1]}, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), OptionRouteByWriterKey(true), OptionPacketQueueSize(2))
+	w := m.newWorker(0)
+
+	var aclGID uint32 = 1
+	for w.router.owner(zerodoc.CLOUD, getWriterKey(0, 0, uint16(aclGID))) != 1 {
+		aclGID++
+	}
+	// 接收方不消费，第3个块覆盖最旧的块
+	for i := 0; i < 3; i++ {
+		block := datatype.AcquireMetaPacketBlock()
+		block.Metas[0] = *newPolicyPacket(time.Second, 64, aclGID)
+		block.Count = 1
+		w.processBlock(block, nil)
+	}
+	if w.ForwardedPackets != 3 || w.ForwardOverwrites != 1 {
+		t.Errorf("expected 3 forwarded packets and 1 overwrite, got %d and %d", w.ForwardedPackets, w.ForwardOverwrites)
+	}
+	// 被覆盖的块已由队列释放，其数组被回收
+	for i := range w.router.inflight {
+		w.router.reclaim(i)
+	}
+	if len(w.router.inflight[1]) != 2 || len(w.router.scratch) != 1 {
+		t.Errorf("expected 2 blocks in flight and 1 array reclaimed, got %d and %d", len(w.router.inflight[1]), len(w.router.scratch))
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+type flowSummary struct {
+	IP0      string `json:"ip_0"`
+	Port0    uint16 `json:"port_0"`
+	IP1      string `json:"ip_1"`
+	Port1    uint16 `json:"port_1"`
+	Protocol string `json:"protocol"`
+}
+
+// fileSummary is written to <file>.json next to each finalized file, so that
+// captures can be indexed without parsing them
+type fileSummary struct {
+	Filename    string            `json:"filename"`
+	TapType     string            `json:"tap_type"`
+	TapPort     string            `json:"tap_port"`
+	VtapID      uint16            `json:"vtap_id"`
+	AclGID      uint16            `json:"acl_gid"`
+	Flow        *flowSummary      `json:"flow,omitempty"` // only with WRITER_KEY_BY_FLOW
+	PacketCount uint64            `json:"packet_count"`
+	Bytes       int64             `json:"bytes"`
+	StartTime   time.Time         `json:"start_time"`
+	EndTime     time.Time         `json:"end_time"`
+	Protocols   map[string]uint64 `json:"protocols,omitempty"` // packets of each IP protocol, non-IP packets are not counted
+}
+
+// countProtocol is called for each packet written if summaries are enabled
+func (w *WrappedWriter) countProtocol(packet *datatype.MetaPacket) {
+	if packet.EthType != layers.EthernetTypeIPv4 && packet.EthType != layers.EthernetTypeIPv6 {
+		return
+	}
+	if w.protocols == nil {
+		w.protocols = make(map[layers.IPProtocol]uint64)
+	}
+	w.protocols[packet.Protocol]++
+}
+
+func (w *WrappedWriter) getSummary(filename string, size int64) *fileSummary {
+	summary := &fileSummary{
+		Filename:    filepath.Base(filename),
+		TapType:     w.tapTypeNames.String(w.tapType),
+		TapPort:     tapPortToMacString(w.tapPort),
+		VtapID:      w.vtapId,
+		AclGID:      w.aclGID,
+		PacketCount: w.packetCount,
+		Bytes:       size,
+		StartTime:   time.Unix(0, int64(w.firstPacketTime)).UTC(),
+		EndTime:     time.Unix(0, int64(w.lastPacketTime)).UTC(),
+	}
+	if w.flowName != "0" {
+		ip0, ip1 := w.flow.ips()
+		summary.Flow = &flowSummary{
+			IP0:      ip0.String(),
+			Port0:    w.flow.port0,
+			IP1:      ip1.String(),
+			Port1:    w.flow.port1,
+			Protocol: w.flow.protocol.String(),
+		}
+	}
+	if len(w.protocols) > 0 {
+		summary.Protocols = make(map[string]uint64, len(w.protocols))
+		for protocol, count := range w.protocols {
+			summary.Protocols[protocol.String()] += count
+		}
+	}
+	return summary
+}
+
+// writeSummary is best-effort, failures are only logged since the capture
+// itself is finalized already
+func writeSummary(filename string, summary *fileSummary) {
+	content, err := json.Marshal(summary)
+	if err == nil {
+		err = os.WriteFile(filename+SUMMARY_SUFFIX, content, 0644)
+	}
+	if err != nil {
+		log.Warningf("Failed to write summary of %s: %s", filename, err)
+	}
+}
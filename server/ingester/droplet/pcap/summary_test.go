@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+// waitSummary polls for the summary which is written asynchronously
+func waitSummary(t *testing.T, pattern string) *fileSummary {
+	for i := 0; i < 100; i++ {
+		files, _ := filepath.Glob(pattern)
+		if len(files) == 1 {
+			content, err := os.ReadFile(files[0])
+			summary := &fileSummary{}
+			if err == nil && json.Unmarshal(content, summary) == nil {
+				return summary
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no summary matches %s", pattern)
+	return nil
+}
+
+func TestFlowSummary(t *testing.T) {
+	w := newTestWorker(t, OptionFlowSummary(true), OptionWriterKeyMode(WRITER_KEY_BY_FLOW))
+	packet := newRawPacket(time.Second, 64)
+	packet.EthType = layers.EthernetTypeIPv4
+	packet.Protocol = layers.IPProtocolTCP
+	packet.IpSrc, packet.IpDst = 0x0a000001, 0x0a000002
+	packet.PortSrc, packet.PortDst = 1234, 80
+	w.writePacket(packet, zerodoc.CLOUD, 1)
+	packet.Timestamp = 2 * time.Second
+	w.writePacket(packet, zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+
+	summary := waitSummary(t, filepath.Join(w.baseDirectory, "1", "*.pcap"+SUMMARY_SUFFIX))
+	if _, err := os.Stat(filepath.Join(w.baseDirectory, "1", summary.Filename)); err != nil {
+		t.Errorf("summary should name the pcap file: %s", err)
+	}
+	if summary.TapType != "tor" || summary.AclGID != 1 || summary.PacketCount != 2 || summary.Bytes != GLOBAL_HEADER_LEN+2*(RECORD_HEADER_LEN+64) {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if !summary.StartTime.Equal(time.Unix(1, 0)) || !summary.EndTime.Equal(time.Unix(2, 0)) {
+		t.Errorf("unexpected times %s - %s", summary.StartTime, summary.EndTime)
+	}
+	if summary.Flow == nil || *summary.Flow != (flowSummary{IP0: "10.0.0.1", Port0: 1234, IP1: "10.0.0.2", Port1: 80, Protocol: "TCP"}) {
+		t.Errorf("unexpected flow %+v", summary.Flow)
+	}
+	if len(summary.Protocols) != 1 || summary.Protocols["TCP"] != 2 {
+		t.Errorf("unexpected protocols %v", summary.Protocols)
+	}
+
+	// 默认不写summary
+	w = newTestWorker(t)
+	w.writePacket(packet, zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	if files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*"+SUMMARY_SUFFIX)); len(files) != 0 {
+		t.Errorf("unexpected summaries %v", files)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+// TapTypeNames names tap types in filenames and events, overriding "tor" for
+// 3 and "ispN" for the others. Types not in the table keep the default names,
+// so a nil table is the default.
+type TapTypeNames map[zerodoc.TAPTypeEnum]string
+
+func (n TapTypeNames) String(tapType zerodoc.TAPTypeEnum) string {
+	if name, ok := n[tapType]; ok {
+		return name
+	}
+	return tapTypeToString(tapType)
+}
+
+func (n TapTypeNames) Parse(s string) (zerodoc.TAPTypeEnum, error) {
+	for tapType, name := range n {
+		if name == s {
+			return tapType, nil
+		}
+	}
+	tapType, err := stringToTapType(s)
+	if err == nil {
+		if _, ok := n[tapType]; ok {
+			// 被覆盖的默认名称不再生成，避免与其它类型混淆
+			return 0, errInvalidTapType(s)
+		}
+	}
+	return tapType, err
+}
+
+// validateTapTypeNames ignores names which are not a single filename segment,
+// or could be parsed as another tap type
+func validateTapTypeNames(names TapTypeNames) TapTypeNames {
+	valid := make(TapTypeNames, len(names))
+	used := make(map[string]bool)
+	for tapType, name := range names {
+		if name == "" || sanitizeNodeID(name) != name || used[name] {
+			log.Warningf("ignore invalid or duplicated pcap tap type name %q of %d", name, tapType)
+			continue
+		}
+		if defaultType, err := stringToTapType(name); err == nil && defaultType != tapType {
+			log.Warningf("ignore pcap tap type name %q of %d, which is the default name of %d", name, tapType, defaultType)
+			continue
+		}
+		used[name] = true
+		valid[tapType] = name
+	}
+	return valid
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestTapTypeNames(t *testing.T) {
+	// 默认名称与tapTypeToString一致
+	var defaults TapTypeNames
+	for i := 0; i < 256; i++ {
+		tapType := zerodoc.TAPTypeEnum(i)
+		name := defaults.String(tapType)
+		if name != tapTypeToString(tapType) {
+			t.Fatalf("unexpected default name %s of %d", name, i)
+		}
+		if parsed, err := defaults.Parse(name); err != nil || parsed != tapType {
+			t.Fatalf("failed to parse %s: %v", name, err)
+		}
+	}
+
+	names := validateTapTypeNames(TapTypeNames{3: "cloud", 7: "gw", 8: "a_b", 9: "isp5", 10: "isp10", 11: "gw"})
+	if len(names) != 3 || names[3] != "cloud" || names[10] != "isp10" || (names[7] != "gw") == (names[11] != "gw") {
+		t.Fatalf("unexpected valid names %v", names)
+	}
+	if names.String(3) != "cloud" || names.String(1) != "isp1" {
+		t.Errorf("unexpected names %s %s", names.String(3), names.String(1))
+	}
+	for s, expected := range map[string]zerodoc.TAPTypeEnum{"cloud": 3, "isp1": 1, "isp10": 10} {
+		if tapType, err := names.Parse(s); err != nil || tapType != expected {
+			t.Errorf("expected %s to be parsed as %d, got %d: %v", s, expected, tapType, err)
+		}
+	}
+	if _, err := names.Parse("tor"); err == nil {
+		t.Error("overridden default name should not be parsed")
+	}
+
+	w := newTestWorker(t, OptionTapTypeNames{3: "cloud"}, OptionTapTypeDirectory(true))
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "cloud", "cloud_*.pcap"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file named with cloud, got %v", files)
+	}
+	info, err := ParseFilename(files[0], w.tapTypeNames)
+	if err != nil || info.TapType != zerodoc.CLOUD || info.AclGID != 1 {
+		t.Errorf("unexpected replay info %+v: %v", info, err)
+	}
+	if _, err := ParseFilename(files[0], nil); err == nil || !strings.Contains(err.Error(), "cloud") {
+		t.Errorf("custom names should not be parsed by default: %v", err)
+	}
+}
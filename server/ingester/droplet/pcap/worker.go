@@ -17,13 +17,23 @@
 package pcap
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-	"unsafe"
 
+	"github.com/google/gopacket/layers"
 	"github.com/op/go-logging"
 
 	"github.com/deepflowio/deepflow/server/libs/datatype"
@@ -39,16 +49,104 @@ const (
 
 type WriterKey uint64
 
-func getWriterIpv6Key(ip net.IP, aclGID uint16, tapType zerodoc.TAPTypeEnum) WriterKey {
-	ipHash := uint32(0)
-	for i := 0; i < len(ip); i += 4 {
-		ipHash ^= *(*uint32)(unsafe.Pointer(&ip[i]))
+// getWriterKey is used for both IPv4 and IPv6 packets in WRITER_KEY_BY_TAP_PORT
+// mode, vtapId is in the key since it's the index in filenames
+func getWriterKey(tapPort uint32, vtapId, aclGID uint16) WriterKey {
+	return WriterKey((uint64(tapPort) << 32) | (uint64(aclGID) << 16) | uint64(vtapId))
+}
+
+type WriterKeyMode uint8
+
+const (
+	WRITER_KEY_BY_TAP_PORT WriterKeyMode = iota // 每个采集口一个文件
+	WRITER_KEY_BY_FLOW                          // 每条流一个文件，双向的包写入同一文件
+	WRITER_KEY_BY_POLICY                        // 每个策略(aclGID+tapType)一个文件，包含策略匹配的所有包
+)
+
+var writerKeyModeNames = map[string]WriterKeyMode{
+	"tap-port": WRITER_KEY_BY_TAP_PORT,
+	"flow":     WRITER_KEY_BY_FLOW,
+	"policy":   WRITER_KEY_BY_POLICY,
+}
+
+// StringToWriterKeyMode falls back to WRITER_KEY_BY_TAP_PORT for unknown names
+func StringToWriterKeyMode(name string) WriterKeyMode {
+	return writerKeyModeNames[name]
+}
+
+// flowTuple is the direction-normalized 5-tuple of a packet, so that packets of
+// both directions get the same tuple
+type flowTuple struct {
+	ip0, ip1     [net.IPv6len]byte
+	port0, port1 uint16
+	protocol     layers.IPProtocol
+	isIPv6       bool
+}
+
+func newFlowTuple(packet *datatype.MetaPacket) flowTuple {
+	t := flowTuple{port0: packet.PortSrc, port1: packet.PortDst, protocol: packet.Protocol}
+	if packet.EthType == layers.EthernetTypeIPv6 {
+		// To16统一4字节形式的地址，保证同一地址的key和文件名一致
+		copy(t.ip0[:], packet.Ip6Src.To16())
+		copy(t.ip1[:], packet.Ip6Dst.To16())
+		t.isIPv6 = true
+	} else {
+		binary.BigEndian.PutUint32(t.ip0[net.IPv6len-net.IPv4len:], packet.IpSrc)
+		binary.BigEndian.PutUint32(t.ip1[net.IPv6len-net.IPv4len:], packet.IpDst)
+	}
+	if c := bytes.Compare(t.ip0[:], t.ip1[:]); c > 0 || (c == 0 && t.port0 > t.port1) {
+		t.ip0, t.ip1 = t.ip1, t.ip0
+		t.port0, t.port1 = t.port1, t.port0
 	}
-	return WriterKey((uint64(ipHash) << 32) | (uint64(aclGID) << 16) | uint64(tapType))
+	return t
 }
 
-func getWriterKey(tapPort uint32, vtapId, aclGID uint16) WriterKey {
-	return WriterKey((uint64(tapPort) << 32) | (uint64(aclGID) << 16) | uint64(aclGID))
+// getWriterKey hashes the tuple with FNV-1a, the writer keeps the full tuple to
+// detect collisions
+func (t *flowTuple) getWriterKey(aclGID uint16) WriterKey {
+	const prime = 1099511628211
+	hash := uint64(14695981039346656037)
+	for _, b := range t.ip0 {
+		hash = (hash ^ uint64(b)) * prime
+	}
+	for _, b := range t.ip1 {
+		hash = (hash ^ uint64(b)) * prime
+	}
+	isIPv6 := uint64(0)
+	if t.isIPv6 {
+		isIPv6 = 1
+	}
+	for _, v := range []uint64{uint64(t.port0), uint64(t.port1), uint64(t.protocol), uint64(aclGID), isIPv6} {
+		hash = (hash ^ v) * prime
+	}
+	return WriterKey(hash)
+}
+
+func (t *flowTuple) ips() (net.IP, net.IP) {
+	ip0, ip1 := t.ip0[:], t.ip1[:]
+	if !t.isIPv6 {
+		ip0, ip1 = ip0[net.IPv6len-net.IPv4len:], ip1[net.IPv6len-net.IPv4len:]
+	}
+	return append(net.IP(nil), ip0...), append(net.IP(nil), ip1...)
+}
+
+// String is used as a filename segment, so it contains neither '_' nor '.'. IPs
+// are fully expanded in hex without ':', so each address has only one form.
+func (t *flowTuple) String() string {
+	ip0, ip1 := t.ips()
+	return fmt.Sprintf("%x-%d-%x-%d-%d", []byte(ip0), t.port0, []byte(ip1), t.port1, t.protocol)
+}
+
+// FileInfo describes a finished pcap file, it's passed to the OnFileFinalized callback
+type FileInfo struct {
+	Filename    string
+	Format      string // name of the extra OutputFormat, empty for the main file
+	TapType     zerodoc.TAPTypeEnum
+	AclGID      uint16
+	PacketCount uint64
+	Bytes       int64
+	StartTime   time.Duration
+	EndTime     time.Duration
 }
 
 type WrappedWriter struct {
@@ -57,71 +155,384 @@ type WrappedWriter struct {
 	tempFilename    string
 	firstPacketTime time.Duration
 	lastPacketTime  time.Duration
+	packetCount     uint64
+	sequence        int // 同一秒内轮转的文件序号，保证文件名不重复
+
+	tapPort      uint32
+	aclGID       uint16
+	vtapId       uint16
+	tapType      zerodoc.TAPTypeEnum
+	tapTypeNames TapTypeNames
+	nodeID       string
 
-	tapPort uint32
-	aclGID  uint16
-	vtapId  uint16
-	tapType zerodoc.TAPTypeEnum
+	flow     flowTuple // 仅WRITER_KEY_BY_FLOW时有效
+	flowName string
+
+	protocols map[layers.IPProtocol]uint64 // 仅写入summary时统计
+
+	size int64 // 已交给Writer的字节数，包括缓冲区中未落盘的部分
+
+	extraWriters []*formatWriter
+
+	customFilename   bool
+	tapTypeDirectory bool
+	baseDirectory    string // base at the time of creation, the file is finished in it
 }
 
 type WorkerCounter struct {
+	// files
 	FileCreations        uint64 `statsd:"file_creations"`
 	FileCloses           uint64 `statsd:"file_closes"`
 	FileRejections       uint64 `statsd:"file_rejections"`
 	FileCreationFailures uint64 `statsd:"file_creation_failures"`
 	FileWritingFailures  uint64 `statsd:"file_writing_failures"`
-	BufferedCount        uint64 `statsd:"buffered_count"`
-	WrittenCount         uint64 `statsd:"written_count"`
-	BufferedBytes        uint64 `statsd:"buffered_bytes"`
-	WrittenBytes         uint64 `statsd:"written_bytes"`
+	IdleCloses           uint64 `statsd:"idle_closes"`
+	RecoveredFiles       uint64 `statsd:"recovered_files"`
+	TruncatedFiles       uint64 `statsd:"truncated_files"` // partial last records truncated on close
+	RingEvictions        uint64 `statsd:"ring_evictions"`  // oldest files removed from rings
+	BaseDirectoryChanges uint64 `statsd:"base_directory_changes"`
+
+	// written data
+	BufferedCount    uint64 `statsd:"buffered_count"`
+	WrittenCount     uint64 `statsd:"written_count"`
+	BufferedBytes    uint64 `statsd:"buffered_bytes"`
+	WrittenBytes     uint64 `statsd:"written_bytes"`
+	ExtraFormatBytes uint64 `statsd:"extra_format_bytes"` // buffered bytes of all extra output formats, included in BufferedBytes
+
+	// finishing failures
+	EncryptionFailures uint64 `statsd:"encryption_failures"`
+	FailedCaptures     uint64 `statsd:"failed_captures"` // quarantined after write failures
+	InvalidFilenames   uint64 `statsd:"invalid_filenames"`
+	FileRenameFailures uint64 `statsd:"file_rename_failures"`
+
+	// packets
+	InvalidTapTypePackets uint64 `statsd:"invalid_tap_type_packets"`
+	InvalidPackets        uint64 `statsd:"invalid_packets"` // EndpointData is nil
+	OversizedPackets      uint64 `statsd:"oversized_packets"`
+	SkippedTinyPackets    uint64 `statsd:"skipped_tiny_packets"` // PacketLen less than minPacketSize
+	ClockDriftEvents      uint64 `statsd:"clock_drift_events"`
+	ReorderedPackets      uint64 `statsd:"reordered_packets"` // timestamps clamped by monotonic timestamp
+	DecapsulatedPackets   uint64 `statsd:"decapsulated_packets"`
+	FCSStrippedPackets    uint64 `statsd:"fcs_stripped_packets"`
+	ForwardedPackets      uint64 `statsd:"forwarded_packets"`  // sent to the worker owning the writer key
+	ForwardOverwrites     uint64 `statsd:"forward_overwrites"` // forwarded blocks put into a full queue, each overwrites the oldest block
+
+	// limits on new files
+	RateLimitedCreations uint64 `statsd:"rate_limited_creations"`
+	PerAclGidRejections  uint64 `statsd:"per_acl_gid_rejections"`
+	LowDiskRejections    uint64 `statsd:"low_disk_rejections"`
+	CreationRetries      uint64 `statsd:"creation_retries"`
+	CreationBackoffDrops uint64 `statsd:"creation_backoff_drops"` // packets needing a new file within the backoff after a creation failure
+	OverflowPackets      uint64 `statsd:"overflow_packets"`       // held until a file finishes since maxConcurrentFiles is reached
+	OverflowDrops        uint64 `statsd:"overflow_drops"`         // the overflow ring is full
+	FlowBudgetDrops      uint64 `statsd:"flow_budget_drops"`      // packets after a file used up flowByteBudget
+
+	// slow disks and idle workers
+	SlowWrites     uint64 `statsd:"slow_writes"`
+	SlowWriteDrops uint64 `statsd:"slow_write_drops"`
+	SkippedSweeps  uint64 `statsd:"skipped_sweeps"` // ticks without expiry sweep when idle
+
+	// gauges, not reset by GetCounter
+	WriterBufferSize uint64 `statsd:"writer_buffer_size,gauge"` // buffer size of new files
+	FinishBacklog    uint64 `statsd:"finish_backlog,gauge"`     // closed files waiting for the background finisher
+}
+
+// load reads all counters atomically one by one
+func (c *WorkerCounter) load() WorkerCounter {
+	return WorkerCounter{
+		FileCreations:         atomic.LoadUint64(&c.FileCreations),
+		FileCloses:            atomic.LoadUint64(&c.FileCloses),
+		FileRejections:        atomic.LoadUint64(&c.FileRejections),
+		FileCreationFailures:  atomic.LoadUint64(&c.FileCreationFailures),
+		FileWritingFailures:   atomic.LoadUint64(&c.FileWritingFailures),
+		IdleCloses:            atomic.LoadUint64(&c.IdleCloses),
+		RecoveredFiles:        atomic.LoadUint64(&c.RecoveredFiles),
+		TruncatedFiles:        atomic.LoadUint64(&c.TruncatedFiles),
+		RingEvictions:         atomic.LoadUint64(&c.RingEvictions),
+		BaseDirectoryChanges:  atomic.LoadUint64(&c.BaseDirectoryChanges),
+		BufferedCount:         atomic.LoadUint64(&c.BufferedCount),
+		WrittenCount:          atomic.LoadUint64(&c.WrittenCount),
+		BufferedBytes:         atomic.LoadUint64(&c.BufferedBytes),
+		WrittenBytes:          atomic.LoadUint64(&c.WrittenBytes),
+		ExtraFormatBytes:      atomic.LoadUint64(&c.ExtraFormatBytes),
+		EncryptionFailures:    atomic.LoadUint64(&c.EncryptionFailures),
+		FailedCaptures:        atomic.LoadUint64(&c.FailedCaptures),
+		InvalidFilenames:      atomic.LoadUint64(&c.InvalidFilenames),
+		FileRenameFailures:    atomic.LoadUint64(&c.FileRenameFailures),
+		InvalidTapTypePackets: atomic.LoadUint64(&c.InvalidTapTypePackets),
+		InvalidPackets:        atomic.LoadUint64(&c.InvalidPackets),
+		OversizedPackets:      atomic.LoadUint64(&c.OversizedPackets),
+		SkippedTinyPackets:    atomic.LoadUint64(&c.SkippedTinyPackets),
+		ClockDriftEvents:      atomic.LoadUint64(&c.ClockDriftEvents),
+		ReorderedPackets:      atomic.LoadUint64(&c.ReorderedPackets),
+		DecapsulatedPackets:   atomic.LoadUint64(&c.DecapsulatedPackets),
+		FCSStrippedPackets:    atomic.LoadUint64(&c.FCSStrippedPackets),
+		ForwardedPackets:      atomic.LoadUint64(&c.ForwardedPackets),
+		ForwardOverwrites:     atomic.LoadUint64(&c.ForwardOverwrites),
+		RateLimitedCreations:  atomic.LoadUint64(&c.RateLimitedCreations),
+		PerAclGidRejections:   atomic.LoadUint64(&c.PerAclGidRejections),
+		LowDiskRejections:     atomic.LoadUint64(&c.LowDiskRejections),
+		CreationRetries:       atomic.LoadUint64(&c.CreationRetries),
+		CreationBackoffDrops:  atomic.LoadUint64(&c.CreationBackoffDrops),
+		OverflowPackets:       atomic.LoadUint64(&c.OverflowPackets),
+		OverflowDrops:         atomic.LoadUint64(&c.OverflowDrops),
+		FlowBudgetDrops:       atomic.LoadUint64(&c.FlowBudgetDrops),
+		SlowWrites:            atomic.LoadUint64(&c.SlowWrites),
+		SlowWriteDrops:        atomic.LoadUint64(&c.SlowWriteDrops),
+		SkippedSweeps:         atomic.LoadUint64(&c.SkippedSweeps),
+		WriterBufferSize:      atomic.LoadUint64(&c.WriterBufferSize),
+		FinishBacklog:         atomic.LoadUint64(&c.FinishBacklog),
+	}
+}
+
+func (c *WorkerCounter) sub(o *WorkerCounter) {
+	c.FileCreations -= o.FileCreations
+	c.FileCloses -= o.FileCloses
+	c.FileRejections -= o.FileRejections
+	c.FileCreationFailures -= o.FileCreationFailures
+	c.FileWritingFailures -= o.FileWritingFailures
+	c.IdleCloses -= o.IdleCloses
+	c.RecoveredFiles -= o.RecoveredFiles
+	c.TruncatedFiles -= o.TruncatedFiles
+	c.RingEvictions -= o.RingEvictions
+	c.BaseDirectoryChanges -= o.BaseDirectoryChanges
+	c.BufferedCount -= o.BufferedCount
+	c.WrittenCount -= o.WrittenCount
+	c.BufferedBytes -= o.BufferedBytes
+	c.WrittenBytes -= o.WrittenBytes
+	c.ExtraFormatBytes -= o.ExtraFormatBytes
+	c.EncryptionFailures -= o.EncryptionFailures
+	c.FailedCaptures -= o.FailedCaptures
+	c.InvalidFilenames -= o.InvalidFilenames
+	c.FileRenameFailures -= o.FileRenameFailures
+	c.InvalidTapTypePackets -= o.InvalidTapTypePackets
+	c.InvalidPackets -= o.InvalidPackets
+	c.OversizedPackets -= o.OversizedPackets
+	c.SkippedTinyPackets -= o.SkippedTinyPackets
+	c.ClockDriftEvents -= o.ClockDriftEvents
+	c.ReorderedPackets -= o.ReorderedPackets
+	c.DecapsulatedPackets -= o.DecapsulatedPackets
+	c.FCSStrippedPackets -= o.FCSStrippedPackets
+	c.ForwardedPackets -= o.ForwardedPackets
+	c.ForwardOverwrites -= o.ForwardOverwrites
+	c.RateLimitedCreations -= o.RateLimitedCreations
+	c.PerAclGidRejections -= o.PerAclGidRejections
+	c.LowDiskRejections -= o.LowDiskRejections
+	c.CreationRetries -= o.CreationRetries
+	c.CreationBackoffDrops -= o.CreationBackoffDrops
+	c.OverflowPackets -= o.OverflowPackets
+	c.OverflowDrops -= o.OverflowDrops
+	c.FlowBudgetDrops -= o.FlowBudgetDrops
+	c.SlowWrites -= o.SlowWrites
+	c.SlowWriteDrops -= o.SlowWriteDrops
+	c.SkippedSweeps -= o.SkippedSweeps
+	// WriterBufferSize and FinishBacklog are gauges
 }
 
 type Worker struct {
-	packetQueue queue.QueueReader
-	index       int
+	// 计数只增不减，由Process原子更新，放在开头保证64位对齐
+	WorkerCounter
+	reportedCounter WorkerCounter // 上次GetCounter时的值，仅stats协程访问
+
+	packetQueue    queue.QueueReader
+	queueBatchSize int
+	index          int
+	router         *router // nil unless packets are routed by writer key
+
+	// Process持有该锁处理每批数据，使ListOpenCaptures可以安全地读取writers
+	writersLock sync.Mutex
 
 	maxConcurrentFiles int
+	maxFilesPerAclGID  int
+	overflow           *overflowRing // nil if disabled
 	maxFileSize        int64
 	maxFilePeriod      time.Duration
-	baseDirectory      string
+	maxPacketsPerFile  uint64
+	flowByteBudget     int64
+	ringFiles          int
+	rings              map[string]*ring // ring of each writer key, accessed with ringsLock held
+	ringsLock          sync.Mutex       // trimRing may run in the finisher
+	ringPruneTime      time.Duration
+	idleTimeout        time.Duration
+	baseDirectory      string        // base of new files, only accessed by Process
+	nextBaseDirectory  *atomic.Value // updated by WorkerManager.SetBaseDirectory
+	tapTypeDirectory   bool
+	tapTypeNames       TapTypeNames
+	nodeID             string
+	writerKeyMode      WriterKeyMode
 
-	*WorkerCounter
+	invalidTapTypeLogged  bool
+	invalidPacketLogTime  time.Time
+	invalidPacketsLogged  uint64 // InvalidPackets at invalidPacketLogTime
+	invalidFilenameLogged bool
+	writerCount           int64 // atomic
+	aclGIDWriterCount     map[uint16]int
 
 	writers [datatype.TAP_MAX]map[WriterKey]*WrappedWriter
 
-	writerBufferSize int
-	tcpipChecksum    bool
+	rotationClock    RotationClock
+	newestPacketTime time.Duration
+	anchorPacketTime time.Duration // newestPacketTime at anchorWallTime
+	anchorWallTime   time.Time
+	clockDrifting    bool
+
+	writerBufferSize     int
+	minWriterBufferSize  int // adaptive if less than maxWriterBufferSize
+	maxWriterBufferSize  int
+	bufferAdjustTime     time.Time
+	bufferAdjustBytes    uint64 // WrittenBytes at bufferAdjustTime
+	snaplen              int
+	convertBuffer        []byte // measures converted packets if snaplen is less than MAX_HEADER_LEN
+	minPacketSize        int
+	dropOversizedPackets bool
+	tcpipChecksum        bool
+	syncOnClose          bool
+	encryption           cipher.AEAD
+	finisher             *finisher // nil if finishing files is cheap, i.e. neither encrypted nor synced
+	dryRun               bool
+	onFileFinalized      func(*FileInfo)
+	events               *eventLogger
+	filenameFormatter    OptionFilenameFormatter
+	extraFormats         []OutputFormat
+	recoverable          *recoverableFiles
+	creationLimiter      *tokenBucket
+	slowWriteThreshold   time.Duration
+	dropOnSlowWrite      bool
+	slowWriteDropUntil   time.Time
+	createRetries        int
+	createRetryBackoff   time.Duration
+	createFailures       int       // consecutive creation failures, capped at createRetries-1
+	createRetryTime      time.Time // no file is created before it
+	minFreeDiskSpace     int64
+	diskSpaceCheckTime   time.Time
+	lowDiskSpace         bool
+	failoverDirectory    string
+	setBaseDirectory     func(string) error
+
+	quarantineOnWriteFailure bool
+	monotonicTimestamp       bool
+
+	decapsulateTunnel  bool
+	decapsulateBuffer  []byte
+	decapsulatedPacket datatype.MetaPacket
+
+	packetsWithFCS    bool
+	fcsStrippedPacket datatype.MetaPacket
 
-	exiting bool
-	exited  bool
-	exitWg  *sync.WaitGroup
+	flowSummary bool
+
+	idleBackoffTicks int // 0 means disabled
+	idleBackoffMin   time.Duration
+	idleBackoffMax   time.Duration
+	idleTicks        int           // consecutive Gets with ticks only
+	idleBackoff      time.Duration // current sweep interval, 0 if not backing off
+	lastSweepTime    time.Time
+
+	exiting      int32         // atomic, set by Close
+	exited       int32         // atomic, set by Close after Process exits
+	stopped      chan struct{} // closed when Process exits
+	closeTimeout time.Duration
+	stuck        int32 // atomic
 }
 
 func (m *WorkerManager) newWorker(packetQueueID queue.HashKey) *Worker {
-	return &Worker{
-		packetQueue: m.packetQueueReaders[packetQueueID],
-		index:       int(packetQueueID),
+	var events *eventLogger
+	if m.structuredLog {
+		events = newEventLogger(int(packetQueueID), m.tapTypeNames)
+	}
+	var overflow *overflowRing
+	if m.overflowCapacity > 0 {
+		overflow = newOverflowRing(m.overflowCapacity)
+	}
+	var router *router
+	// 按策略合并时各worker的文件名相同，必须由同一个worker写入
+	if (m.routeByWriterKey || m.writerKeyMode == WRITER_KEY_BY_POLICY) && len(m.packetQueueWriters) > 1 {
+		router = newRouter(m.packetQueueWriters, m.packetQueueSize)
+	}
+	snaplen := getSnaplen(m.maxPacketSize)
+	// 缓冲区至少容纳一个最大的记录，否则会截断包
+	minBufferSize, maxBufferSize := getBufferSize(m.minBlockSizeKB<<10, snaplen), m.maxBlockSizeKB<<10
+	if maxBufferSize <= minBufferSize {
+		minBufferSize, maxBufferSize = 0, 0
+	}
+	w := &Worker{
+		WorkerCounter: WorkerCounter{WriterBufferSize: uint64(m.blockSizeKB << 10)},
+
+		packetQueue:    m.packetQueueReaders[packetQueueID],
+		queueBatchSize: m.queueBatchSize,
+		index:          int(packetQueueID),
+		router:         router,
 
 		maxConcurrentFiles: m.maxConcurrentFiles / len(m.packetQueueReaders),
+		maxFilesPerAclGID:  m.maxFilesPerAclGID,
+		overflow:           overflow,
 		maxFileSize:        int64(m.maxFileSizeMB) << 20,
 		maxFilePeriod:      time.Duration(m.maxFilePeriodSecond) * time.Second,
-		baseDirectory:      m.baseDirectory,
+		maxPacketsPerFile:  uint64(m.maxPacketsPerFile),
+		flowByteBudget:     int64(m.flowByteBudgetKB) << 10,
+		ringFiles:          m.ringFiles,
+		idleTimeout:        time.Duration(m.idleTimeoutSecond) * time.Second,
+		baseDirectory:      m.BaseDirectory(),
+		nextBaseDirectory:  &m.nextBaseDirectory,
+		tapTypeDirectory:   m.tapTypeDirectory,
+		tapTypeNames:       m.tapTypeNames,
+		nodeID:             m.nodeID,
+		writerKeyMode:      m.writerKeyMode,
+		rotationClock:      m.rotationClock,
+
+		writerBufferSize:     m.blockSizeKB << 10,
+		minWriterBufferSize:  minBufferSize,
+		maxWriterBufferSize:  maxBufferSize,
+		snaplen:              snaplen,
+		minPacketSize:        m.minPacketSize,
+		dropOversizedPackets: m.dropOversizedPackets,
+		tcpipChecksum:        m.tcpipChecksum,
+		syncOnClose:          m.syncOnClose,
+		encryption:           m.encryption,
+		dryRun:               m.dryRun,
+		onFileFinalized:      m.onFileFinalized,
+		events:               events,
+		filenameFormatter:    m.filenameFormatter,
+		extraFormats:         m.extraFormats,
+		recoverable:          m.recoverable,
+		creationLimiter:      m.creationLimiter,
+		slowWriteThreshold:   time.Duration(m.slowWriteThresholdMs) * time.Millisecond,
+		dropOnSlowWrite:      m.dropOnSlowWrite,
+		createRetries:        m.createRetries,
+		createRetryBackoff:   time.Duration(m.createRetryBackoffMs) * time.Millisecond,
+		minFreeDiskSpace:     int64(m.minFreeDiskSpaceMB) << 20,
+		failoverDirectory:    m.failoverDirectory,
+		setBaseDirectory:     m.SetBaseDirectory,
+
+		quarantineOnWriteFailure: m.quarantineOnWriteFailure,
+		monotonicTimestamp:       m.monotonicTimestamp,
+
+		decapsulateTunnel: m.decapsulateTunnel,
+		packetsWithFCS:    m.packetsWithFCS,
 
-		WorkerCounter: &WorkerCounter{},
+		flowSummary: m.flowSummary,
 
-		writerBufferSize: m.blockSizeKB << 10,
-		tcpipChecksum:    m.tcpipChecksum,
+		idleBackoffTicks: m.idleBackoffTicks,
+		idleBackoffMin:   time.Duration(m.idleBackoffMinMs) * time.Millisecond,
+		idleBackoffMax:   time.Duration(m.idleBackoffMaxMs) * time.Millisecond,
 
-		exiting: false,
-		exited:  false,
-		exitWg:  &sync.WaitGroup{},
+		aclGIDWriterCount: make(map[uint16]int),
+
+		stopped:      make(chan struct{}),
+		closeTimeout: time.Duration(m.closeTimeoutSecond) * time.Second,
+	}
+	if (m.encryption != nil || m.syncOnClose) && !m.dryRun {
+		w.finisher = newFinisher(&w.FinishBacklog)
 	}
+	return w
 }
 
 func tapPortToMacString(tapPort uint32) string {
 	return fmt.Sprintf("%012x", tapPort)
 }
 
+// tapTypeToString covers the whole 8-bit range of zerodoc.TAPTypeEnum, values
+// beyond it are rejected in processPacket before conversion
 func tapTypeToString(tapType zerodoc.TAPTypeEnum) string {
 	if tapType == 3 {
 		return "tor"
@@ -133,16 +544,144 @@ func formatDuration(d time.Duration) string {
 	return time.Unix(0, int64(d)).Format(TIME_FORMAT)
 }
 
-func getTempFilename(tapType zerodoc.TAPTypeEnum, tapPort uint32, firstPacketTime time.Duration, index uint16) string {
-	return fmt.Sprintf("%s_%s_0_%s_.%d.pcap.temp", tapTypeToString(tapType), tapPortToMacString(tapPort), formatDuration(firstPacketTime), index)
+// formatIndex zero-pads the index so that filenames sort lexicographically
+func formatIndex(nodeID string, index uint16) string {
+	if nodeID == "" {
+		return fmt.Sprintf("%05d", index)
+	}
+	return fmt.Sprintf("%s-%05d", nodeID, index)
+}
+
+// formatFirstPacketTime appends the sequence of files rotated within the same
+// second, zero-padded so that filenames still sort by time
+func formatFirstPacketTime(firstPacketTime time.Duration, sequence int) string {
+	if sequence == 0 {
+		return formatDuration(firstPacketTime)
+	}
+	return fmt.Sprintf("%s-%03d", formatDuration(firstPacketTime), sequence)
+}
+
+func getTempFilename(tapType string, tapPort uint32, flowName string, firstPacketTime time.Duration, sequence int, nodeID string, index uint16) string {
+	return fmt.Sprintf("%s_%s_%s_%s_.%s.pcap.temp", tapType, tapPortToMacString(tapPort), flowName, formatFirstPacketTime(firstPacketTime, sequence), formatIndex(nodeID, index))
+}
+
+// getDirectory returns <base>/<aclGID>, or <base>/<aclGID>/<tapType> if tapTypeDirectory
+func (w *WrappedWriter) getDirectory(base string) string {
+	if w.tapTypeDirectory {
+		return fmt.Sprintf("%s/%d/%s", base, w.aclGID, w.tapTypeNames.String(w.tapType))
+	}
+	return fmt.Sprintf("%s/%d", base, w.aclGID)
 }
 
 func (w *WrappedWriter) getTempFilename(base string) string {
-	return fmt.Sprintf("%s/%d/%s", base, w.aclGID, getTempFilename(w.tapType, w.tapPort, w.firstPacketTime, w.vtapId))
+	return fmt.Sprintf("%s/%s", w.getDirectory(base), getTempFilename(w.tapTypeNames.String(w.tapType), w.tapPort, w.flowName, w.firstPacketTime, w.sequence, w.nodeID, w.vtapId))
 }
 
 func (w *WrappedWriter) getFilename(base string) string {
-	return fmt.Sprintf("%s/%d/%s_%s_0_%s_%s.%d.pcap", base, w.aclGID, tapTypeToString(w.tapType), tapPortToMacString(w.tapPort), formatDuration(w.firstPacketTime), formatDuration(w.lastPacketTime), w.vtapId)
+	return fmt.Sprintf("%s/%s_%s_%s_%s_%s.%s.pcap", w.getDirectory(base), w.tapTypeNames.String(w.tapType), tapPortToMacString(w.tapPort), w.flowName, formatFirstPacketTime(w.firstPacketTime, w.sequence), formatDuration(w.lastPacketTime), formatIndex(w.nodeID, w.vtapId))
+}
+
+func (w *WrappedWriter) TapType() zerodoc.TAPTypeEnum {
+	return w.tapType
+}
+
+func (w *WrappedWriter) TapPort() uint32 {
+	return w.tapPort
+}
+
+func (w *WrappedWriter) AclGID() uint16 {
+	return w.aclGID
+}
+
+func (w *WrappedWriter) VtapId() uint16 {
+	return w.vtapId
+}
+
+func (w *WrappedWriter) NodeID() string {
+	return w.nodeID
+}
+
+func (w *WrappedWriter) FlowName() string {
+	return w.flowName
+}
+
+func (w *WrappedWriter) FirstPacketTime() time.Duration {
+	return w.firstPacketTime
+}
+
+func (w *WrappedWriter) LastPacketTime() time.Duration {
+	return w.lastPacketTime
+}
+
+// Sequence is non-zero if the file is rotated within the same second as the
+// first packet of the previous file of its writer key, custom filenames should
+// include it to be unique
+func (w *WrappedWriter) Sequence() int {
+	return w.sequence
+}
+
+// DefaultFilenameFormatter is used if no OptionFilenameFormatter is specified
+func DefaultFilenameFormatter(writer *WrappedWriter, base string) string {
+	return writer.getFilename(base)
+}
+
+// isInDirectory checks path against traversal out of base such as "../"
+func isInDirectory(path, base string) bool {
+	relative, err := filepath.Rel(base, path)
+	return err == nil && relative != "." && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) && !filepath.IsAbs(relative)
+}
+
+// formatFilename falls back to the default formatter if the custom one generates
+// a path out of the base directory of the writer, or without the ".pcap" suffix
+// which libs/pcap.Cleaner recognizes, otherwise the file would never be cleaned
+func (w *Worker) formatFilename(writer *WrappedWriter) (string, bool) {
+	if w.filenameFormatter == nil {
+		return writer.getFilename(writer.baseDirectory), false
+	}
+	filename := w.filenameFormatter(writer, writer.baseDirectory)
+	if !isInDirectory(filename, writer.baseDirectory) || !strings.HasSuffix(filename, ".pcap") {
+		if !w.invalidFilenameLogged {
+			w.invalidFilenameLogged = true
+			log.Warningf("filename %s generated by custom formatter is not a .pcap file in %s, use the default format instead, further occurrences are only counted", filename, writer.baseDirectory)
+		}
+		atomic.AddUint64(&w.InvalidFilenames, 1)
+		return writer.getFilename(writer.baseDirectory), false
+	}
+	return filename, true
+}
+
+func (w *Worker) getFilename(writer *WrappedWriter) string {
+	if writer.customFilename {
+		// 与临时文件保持一致，避免同一文件的临时名与最终名使用不同格式
+		if filename, ok := w.formatFilename(writer); ok {
+			return filename
+		}
+		return strings.TrimSuffix(writer.tempFilename, TEMP_SUFFIX)
+	}
+	return writer.getFilename(writer.baseDirectory)
+}
+
+// getTempFilename is the custom filename with TEMP_SUFFIX at the time of creation
+func (w *Worker) getTempFilename(writer *WrappedWriter) string {
+	filename, ok := w.formatFilename(writer)
+	if !ok {
+		return writer.getTempFilename(writer.baseDirectory)
+	}
+	writer.customFilename = true
+	return filename + TEMP_SUFFIX
+}
+
+// packetLinkType detects packets captured without L2 header, i.e. whose
+// RawHeader starts with the IP header directly
+func packetLinkType(packet *datatype.MetaPacket) layers.LinkType {
+	if packet.RawHeaderSize == 0 || packet.MacSrc != 0 || packet.MacDst != 0 {
+		return layers.LinkTypeEthernet
+	}
+	version := packet.RawHeader[0] >> 4
+	if (packet.EthType == layers.EthernetTypeIPv4 && version == 4) || (packet.EthType == layers.EthernetTypeIPv6 && version == 6) {
+		return layers.LinkTypeRaw
+	}
+	return layers.LinkTypeEthernet
 }
 
 func (w *Worker) shouldCloseFile(writer *WrappedWriter, packet *datatype.MetaPacket) bool {
@@ -154,101 +693,645 @@ func (w *Worker) shouldCloseFile(writer *WrappedWriter, packet *datatype.MetaPac
 	if packet.Timestamp-writer.firstPacketTime > w.maxFilePeriod {
 		return true
 	}
+	if w.maxPacketsPerFile > 0 && writer.packetCount >= w.maxPacketsPerFile {
+		return true
+	}
 	return false
 }
 
+var (
+	rename        = os.Rename
+	truncate      = os.Truncate
+	mkdirAll      = os.MkdirAll
+	createWriter  = NewWriter
+	diskFreeSpace = statfsFreeSpace
+)
+
+// statfsFreeSpace returns the space available to unprivileged users on the
+// filesystem of path
+func statfsFreeSpace(path string) (int64, error) {
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
+
+// isLowDiskSpace checks free space of base every DISK_SPACE_CHECK_INTERVAL,
+// the result is cached in between, and errors of statfs are ignored
+func (w *Worker) isLowDiskSpace(base string) bool {
+	if w.minFreeDiskSpace <= 0 || w.dryRun {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(w.diskSpaceCheckTime) < DISK_SPACE_CHECK_INTERVAL {
+		return w.lowDiskSpace
+	}
+	w.diskSpaceCheckTime = now
+	free, err := diskFreeSpace(base)
+	if err != nil {
+		return w.lowDiskSpace
+	}
+	if low := free < w.minFreeDiskSpace; low != w.lowDiskSpace {
+		if low {
+			log.Warningf("Free space of %s is %d bytes, less than %d, stop creating pcap files", base, free, w.minFreeDiskSpace)
+		} else {
+			log.Infof("Free space of %s is %d bytes, resume creating pcap files", base, free)
+		}
+		w.lowDiskSpace = low
+	}
+	return w.lowDiskSpace
+}
+
+// failover switches all workers to failoverDirectory when base is low on disk
+// space, it returns whether the base directory is changed
+func (w *Worker) failover(base string) bool {
+	if w.failoverDirectory == "" || base == w.failoverDirectory {
+		return false
+	}
+	if err := w.setBaseDirectory(w.failoverDirectory); err != nil {
+		log.Warningf("Failed to fail over from %s: %s", base, err)
+		return false
+	}
+	return true
+}
+
+// renameFile falls back to copy and remove if src and dst are on different devices
+func renameFile(src, dst string) error {
+	err := rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// finishWriter closes the files of writer, they're finalized by finalizeWriter
+// in the finisher if any
 func (w *Worker) finishWriter(writer *WrappedWriter, newFilename string) {
+	err := w.closeFile(writer.Writer, writer.tempFilename)
+	extraErrs := w.closeExtraWriters(writer)
+	w.addWriterCount(writer.aclGID, -1)
+	w.finish(func() {
+		w.finalizeWriter(writer, newFilename, err)
+		w.finalizeExtraWriters(writer, newFilename, extraErrs)
+	})
+}
+
+// finalizeWriter renames or encrypts the closed temp file of writer, it's
+// quarantined if closing failed with err
+func (w *Worker) finalizeWriter(writer *WrappedWriter, newFilename string, err error) {
+	var filename string
+	var finalized bool
+	if err == nil {
+		log.Debugf("Finish writing %s, renaming to %s", writer.tempFilename, newFilename)
+		filename, finalized, err = w.finalizeFile(writer.tempFilename, newFilename)
+	} else {
+		filename = w.quarantineTempFile(writer.tempFilename)
+	}
+	if err == nil {
+		atomic.AddUint64(&w.FileCloses, 1)
+	}
+	w.events.log(EVENT_FILE_CLOSE, writer.tapType, writer.aclGID, writer, filename, err)
+	if finalized && w.onFileFinalized != nil {
+		// 回调可能较慢，异步执行以免阻塞Process
+		go w.onFileFinalized(&FileInfo{
+			Filename:    filename,
+			TapType:     writer.tapType,
+			AclGID:      writer.aclGID,
+			PacketCount: writer.packetCount,
+			Bytes:       w.finishedSize(writer.FileSize()),
+			StartTime:   writer.firstPacketTime,
+			EndTime:     writer.lastPacketTime,
+		})
+	}
+	if finalized && w.flowSummary {
+		go writeSummary(filename, writer.getSummary(filename, w.finishedSize(writer.FileSize())))
+	}
+	if finalized {
+		w.trimRing(writer, filename)
+	}
+}
+
+// closeFile returns an error if the file ends with a partial record which
+// fails to be truncated, the file should not be finished in this case
+func (w *Worker) closeFile(writer *Writer, tempFilename string) error {
+	writer.Close()
+	counter := writer.GetAndResetStats()
+	w.addWriterCounter(&counter)
+	goodSize, partial := writer.PartialRecord()
+	if !partial {
+		return nil
+	}
+	// 截断到最后一个完整记录，避免读取方解析到半条记录
+	if err := truncate(tempFilename, goodSize); err != nil {
+		log.Warningf("Failed to truncate the partial record of %s: %s", tempFilename, err)
+		return err
+	}
+	writer.partialRecordTruncated()
+	atomic.AddUint64(&w.TruncatedFiles, 1)
+	log.Infof("Truncate the partial record of %s at %d", tempFilename, goodSize)
+	return nil
+}
+
+// finalizeFile renames or encrypts a closed temp file to newFilename, it returns
+// the final filename and whether the file is finalized
+func (w *Worker) finalizeFile(tempFilename, newFilename string) (string, bool, error) {
+	if w.dryRun {
+		return newFilename, false, nil
+	}
+	if w.encryption != nil {
+		if err := encryptTempFile(w.encryption, tempFilename, newFilename, w.syncOnClose); err != nil {
+			// 保留明文临时文件，重启时由markAndCleanTempFiles再次加密
+			log.Warningf("Failed to encrypt %s, temp file is kept: %s", tempFilename, err)
+			atomic.AddUint64(&w.EncryptionFailures, 1)
+			return newFilename, false, err
+		}
+		return newFilename + ENCRYPTED_SUFFIX, true, nil
+	}
+	if w.syncOnClose {
+		// 确保重命名前数据已落盘，避免宕机后留下看似完整的截断文件
+		if err := syncFile(tempFilename); err != nil {
+			log.Warningf("Failed to sync %s: %s", tempFilename, err)
+		}
+	}
+	if err := renameFile(tempFilename, newFilename); err != nil {
+		// 保留临时文件，重启时由markAndCleanTempFiles再次处理
+		log.Warningf("Failed to rename %s to %s, temp file is kept: %s", tempFilename, newFilename, err)
+		atomic.AddUint64(&w.FileRenameFailures, 1)
+		return newFilename, false, err
+	}
+	return newFilename, true, nil
+}
+
+// finishedSize returns the size of a finished file of size bytes on disk
+func (w *Worker) finishedSize(size int64) int64 {
+	if w.encryption != nil {
+		return encryptedSize(w.encryption, size)
+	}
+	return size
+}
+
+// quarantineWriter closes a capture failed to write and keeps its temp files
+// for post-mortem, the following packets go to a new capture
+func (w *Worker) quarantineWriter(tapType zerodoc.TAPTypeEnum, key WriterKey, writer *WrappedWriter) {
+	w.quarantineFile(writer.Writer, writer.tempFilename)
+	for _, extra := range writer.extraWriters {
+		w.quarantineFile(extra.Writer, extra.tempFilename)
+	}
+	atomic.AddUint64(&w.FailedCaptures, 1)
+	w.addWriterCount(writer.aclGID, -1)
+	w.events.log(EVENT_FILE_QUARANTINE, tapType, writer.aclGID, writer, writer.tempFilename+QUARANTINE_SUFFIX, nil)
+	delete(w.writers[tapType], key)
+}
+
+// quarantineFile renames the temp file with QUARANTINE_SUFFIX, so that it's
+// neither finished on restart nor appended to by a new writer of the same name
+func (w *Worker) quarantineFile(writer *Writer, tempFilename string) {
 	writer.Close()
 	counter := writer.GetAndResetStats()
-	w.BufferedCount += counter.totalBufferedCount
-	w.WrittenCount += counter.totalWrittenCount
-	w.BufferedBytes += counter.totalBufferedBytes
-	w.WrittenBytes += counter.totalWrittenBytes
-	log.Debugf("Finish writing %s, renaming to %s", writer.tempFilename, newFilename)
-	os.Rename(writer.tempFilename, newFilename)
-	w.FileCloses++
+	w.addWriterCounter(&counter)
+	w.finish(func() { w.quarantineTempFile(tempFilename) })
+}
+
+// quarantineTempFile returns the name of the quarantined file
+func (w *Worker) quarantineTempFile(tempFilename string) string {
+	if w.dryRun {
+		return tempFilename
+	}
+	filename := tempFilename + QUARANTINE_SUFFIX
+	var err error
+	if w.encryption != nil {
+		// 隔离的文件同样不能以明文保留
+		err = encryptTempFile(w.encryption, tempFilename, filename, w.syncOnClose)
+		filename += ENCRYPTED_SUFFIX
+	} else {
+		err = rename(tempFilename, filename)
+	}
+	if err != nil {
+		log.Warningf("Failed to quarantine %s: %s", tempFilename, err)
+		return tempFilename
+	}
+	log.Warningf("Quarantine %s as %s after write failure", tempFilename, filename)
+	return filename
+}
+
+// checkWriteLatency counts writes taking longer than slowWriteThreshold,
+// packets are dropped for SLOW_WRITE_BACKOFF after a slow write if dropOnSlowWrite
+func (w *Worker) checkWriteLatency(writer *WrappedWriter, latency time.Duration) {
+	if latency <= w.slowWriteThreshold {
+		return
+	}
+	atomic.AddUint64(&w.SlowWrites, 1)
+	if !w.dropOnSlowWrite {
+		log.Debugf("Writing to %s takes %s, exceeds %s", writer.tempFilename, latency, w.slowWriteThreshold)
+		return
+	}
+	log.Warningf("Writing to %s takes %s, exceeds %s, drop packets for %s", writer.tempFilename, latency, w.slowWriteThreshold, SLOW_WRITE_BACKOFF)
+	w.slowWriteDropUntil = time.Now().Add(SLOW_WRITE_BACKOFF)
+}
+
+// getWriterKey returns the key in w.writers, flow is only set in WRITER_KEY_BY_FLOW
+// mode, in which the key is a hash and the writer should be checked against flow
+func (w *Worker) getWriterKey(packet *datatype.MetaPacket, aclGID uint16) (WriterKey, flowTuple) {
+	switch w.writerKeyMode {
+	case WRITER_KEY_BY_FLOW:
+		flow := newFlowTuple(packet)
+		return flow.getWriterKey(aclGID), flow
+	case WRITER_KEY_BY_POLICY:
+		// w.writers已按tapType区分
+		return getWriterKey(0, 0, aclGID), flowTuple{}
+	}
+	return getWriterKey(packet.TapPort, packet.VtapId, aclGID), flowTuple{}
+}
+
+// closeWriter is the only way to remove a writer from w.writers
+func (w *Worker) closeWriter(tapType zerodoc.TAPTypeEnum, key WriterKey, writer *WrappedWriter) {
+	w.finishWriter(writer, w.getFilename(writer))
+	delete(w.writers[tapType], key)
 }
 
 func (w *Worker) writePacket(packet *datatype.MetaPacket, tapType zerodoc.TAPTypeEnum, aclGID uint16) {
+	linkType := packetLinkType(packet)
+	if w.decapsulateTunnel {
+		if decapsulated := w.decapsulate(packet); decapsulated != nil {
+			packet, linkType = decapsulated, layers.LinkTypeEthernet
+		}
+	}
+	if w.packetsWithFCS {
+		if stripped := w.stripFCS(packet, linkType); stripped != nil {
+			packet = stripped
+		}
+	}
+	if int(packet.PacketLen) < w.minPacketSize {
+		// 避免写入无效的记录
+		atomic.AddUint64(&w.SkippedTinyPackets, 1)
+		return
+	}
+	// jumbo帧等超过snaplen的包，默认由Writer截断写入
+	if w.isOversized(packet) {
+		atomic.AddUint64(&w.OversizedPackets, 1)
+		if w.dropOversizedPackets {
+			return
+		}
+	}
+	if !w.slowWriteDropUntil.IsZero() {
+		if time.Now().Before(w.slowWriteDropUntil) {
+			atomic.AddUint64(&w.SlowWriteDrops, 1)
+			return
+		}
+		// 退避结束后放行写入，由写入耗时判断磁盘是否恢复
+		w.slowWriteDropUntil = time.Time{}
+	}
+	w.writeToWriter(packet, tapType, aclGID, linkType)
+}
+
+// isOversized compares the length of the record data of packet before
+// truncation with snaplen, it's RawHeaderSize if any, otherwise the length of
+// the frame converted from the header fields, which is at most MAX_HEADER_LEN
+func (w *Worker) isOversized(packet *datatype.MetaPacket) bool {
+	if packet.RawHeaderSize > 0 {
+		return int(packet.RawHeaderSize) > w.snaplen
+	}
+	if w.snaplen >= MAX_HEADER_LEN {
+		return false
+	}
+	if w.convertBuffer == nil {
+		w.convertBuffer = make([]byte, MAX_HEADER_LEN)
+	}
+	return NewRawPacket(w.convertBuffer).MetaPacketToRaw(packet, false) > w.snaplen
+}
+
+// writeToWriter writes the packet passed all checks to the writer of its key
+func (w *Worker) writeToWriter(packet *datatype.MetaPacket, tapType zerodoc.TAPTypeEnum, aclGID uint16, linkType layers.LinkType) {
 	if w.writers[tapType] == nil {
 		w.writers[tapType] = make(map[WriterKey]*WrappedWriter)
 	}
-	key := getWriterKey(packet.TapPort, packet.VtapId, aclGID)
+	key, flow := w.getWriterKey(packet, aclGID)
 	writer, exist := w.writers[tapType][key]
-	if exist && w.shouldCloseFile(writer, packet) {
-		newFilename := writer.getFilename(w.baseDirectory)
-		w.finishWriter(writer, newFilename)
-		delete(w.writers[tapType], key)
-		exist = false
+	// 哈希冲突时结束旧文件，保证每个文件只包含一条流；linktype在文件头中，变化时也需要换文件
+	rotated, sequence := false, 0
+	if exist && (writer.flow != flow || writer.LinkType() != linkType || w.shouldCloseFile(writer, packet)) {
+		// 文件名中的时间精确到秒，同一秒内轮转的文件需要序号区分，否则重命名时会覆盖
+		if packet.Timestamp/time.Second == writer.firstPacketTime/time.Second {
+			sequence = writer.sequence + 1
+		}
+		w.closeWriter(tapType, key, writer)
+		exist, rotated = false, true
+	}
+	if exist && w.flowByteBudget > 0 && writer.size >= w.flowByteBudget {
+		// 与maxFileSize不同，预算用完后不换文件，直到正常轮转
+		atomic.AddUint64(&w.FlowBudgetDrops, 1)
+		return
 	}
 	if !exist {
-		writer = w.generateWrappedWriter(tapType, aclGID, packet)
+		if w.overflow != nil && w.WriterCount() >= w.maxConcurrentFiles {
+			w.holdPacket(packet, tapType, aclGID, linkType)
+			return
+		}
+		// 轮转不增加文件数，不受限速影响，避免活跃的流被新流饿死
+		if !rotated && w.creationLimiter != nil && !w.creationLimiter.take(packet.Timestamp) {
+			atomic.AddUint64(&w.RateLimitedCreations, 1)
+			return
+		}
+		writer = w.generateWrappedWriter(tapType, aclGID, &flow, linkType, packet, sequence)
 		if writer == nil {
 			return
 		}
 		w.writers[tapType][key] = writer
 	}
-	if err := writer.Write(packet); err != nil {
+	var start time.Time
+	if w.slowWriteThreshold > 0 {
+		start = time.Now()
+	}
+	err := writer.Write(packet)
+	if w.slowWriteThreshold > 0 {
+		w.checkWriteLatency(writer, time.Since(start))
+	}
+	if err != nil {
 		log.Debugf("Failed to write packet to %s: %s", writer.tempFilename, err)
-		w.FileWritingFailures++
+		atomic.AddUint64(&w.FileWritingFailures, 1)
+		w.events.log(EVENT_WRITE_FAILED, tapType, aclGID, writer, writer.tempFilename, err)
+		if w.quarantineOnWriteFailure {
+			w.quarantineWriter(tapType, key, writer)
+		}
 		return
 	}
 	counter := writer.GetAndResetStats()
-	w.BufferedCount += counter.totalBufferedCount
-	w.WrittenCount += counter.totalWrittenCount
-	w.BufferedBytes += counter.totalBufferedBytes
-	w.WrittenBytes += counter.totalWrittenBytes
-	writer.lastPacketTime = packet.Timestamp
+	w.addWriterCounter(&counter)
+	writer.size += int64(counter.totalBufferedBytes)
+	w.writeExtraWriters(writer, packet)
+	if !w.monotonicTimestamp || packet.Timestamp > writer.lastPacketTime {
+		writer.lastPacketTime = packet.Timestamp
+	}
+	writer.packetCount++
+	if w.flowSummary {
+		writer.countProtocol(packet)
+	}
 }
 
-func (w *Worker) generateWrappedWriter(tapType zerodoc.TAPTypeEnum, aclGID uint16, packet *datatype.MetaPacket) *WrappedWriter {
-	if len(w.writers) >= w.maxConcurrentFiles {
+// updateBaseDirectory picks up the directory set by WorkerManager.SetBaseDirectory,
+// it's only checked on file creation so that open files are not moved
+func (w *Worker) updateBaseDirectory(tapType zerodoc.TAPTypeEnum, aclGID uint16) string {
+	if w.nextBaseDirectory == nil {
+		return w.baseDirectory
+	}
+	if next := w.nextBaseDirectory.Load().(string); next != w.baseDirectory {
+		log.Infof("pcap worker %d switches base directory from %s to %s, open files are finished in the former", w.index, w.baseDirectory, next)
+		atomic.AddUint64(&w.BaseDirectoryChanges, 1)
+		w.events.log(EVENT_BASE_DIR_CHANGE, tapType, aclGID, nil, next, nil)
+		w.baseDirectory = next
+		// 缓存的是原目录的剩余空间，需要重新检查新目录
+		w.diskSpaceCheckTime, w.lowDiskSpace = time.Time{}, false
+	}
+	return w.baseDirectory
+}
+
+func (w *Worker) generateWrappedWriter(tapType zerodoc.TAPTypeEnum, aclGID uint16, flow *flowTuple, linkType layers.LinkType, packet *datatype.MetaPacket, sequence int) *WrappedWriter {
+	if w.WriterCount() >= w.maxConcurrentFiles {
 		if log.IsEnabledFor(logging.DEBUG) {
 			log.Debugf("Max concurrent file (%d files) exceeded", w.maxConcurrentFiles)
 		}
-		w.FileRejections++
+		atomic.AddUint64(&w.FileRejections, 1)
+		w.events.log(EVENT_FILE_REJECT, tapType, aclGID, nil, "", nil)
 		return nil
 	}
-
-	directory := fmt.Sprintf("%s/%d", w.baseDirectory, aclGID)
-	if _, err := os.Stat(directory); os.IsNotExist(err) {
-		os.MkdirAll(directory, os.ModePerm)
+	if w.maxFilesPerAclGID > 0 && w.aclGIDWriterCount[aclGID] >= w.maxFilesPerAclGID {
+		// 避免单个策略占满全部并发文件
+		atomic.AddUint64(&w.PerAclGidRejections, 1)
+		w.events.log(EVENT_FILE_REJECT, tapType, aclGID, nil, "", nil)
+		return nil
 	}
+
 	writer := &WrappedWriter{
-		tapType:         tapType,
-		aclGID:          aclGID,
-		vtapId:          packet.VtapId,
-		tapPort:         packet.TapPort,
-		firstPacketTime: packet.Timestamp,
-		lastPacketTime:  packet.Timestamp,
+		tapType:          tapType,
+		tapTypeNames:     w.tapTypeNames,
+		aclGID:           aclGID,
+		vtapId:           packet.VtapId,
+		tapPort:          packet.TapPort,
+		nodeID:           w.nodeID,
+		flow:             *flow,
+		tapTypeDirectory: w.tapTypeDirectory,
+		baseDirectory:    w.updateBaseDirectory(tapType, aclGID),
+		flowName:         "0",
+		firstPacketTime:  packet.Timestamp,
+		lastPacketTime:   packet.Timestamp,
+		sequence:         sequence,
+	}
+	switch w.writerKeyMode {
+	case WRITER_KEY_BY_FLOW:
+		writer.flowName = flow.String()
+	case WRITER_KEY_BY_POLICY:
+		// 文件包含多个采集器和采集口的包，文件名中不体现首包的
+		writer.vtapId, writer.tapPort = 0, 0
+	}
+
+	if w.isLowDiskSpace(writer.baseDirectory) && w.failover(writer.baseDirectory) {
+		writer.baseDirectory = w.updateBaseDirectory(tapType, aclGID)
+	}
+	if w.isLowDiskSpace(writer.baseDirectory) {
+		// 已打开的文件继续写入，只拒绝新文件
+		atomic.AddUint64(&w.LowDiskRejections, 1)
+		w.events.log(EVENT_FILE_REJECT, tapType, aclGID, nil, "", nil)
+		return nil
 	}
 
-	writer.tempFilename = writer.getTempFilename(w.baseDirectory)
+	if w.isCreationBackingOff() {
+		atomic.AddUint64(&w.CreationBackoffDrops, 1)
+		return nil
+	}
+
+	writer.tempFilename = w.getTempFilename(writer)
+	recovered := false
+	if w.recoverable != nil && !writer.customFilename {
+		if file := w.recoverable.take(recoveryKey(writer.tempFilename)); file != nil {
+			if packet.Timestamp-file.firstPacketTime <= w.maxFilePeriod && file.linkType == linkType && file.snaplen == w.snaplen {
+				writer.tempFilename = file.tempFilename
+				writer.firstPacketTime = file.firstPacketTime
+				writer.lastPacketTime = file.lastPacketTime
+				writer.packetCount = file.packetCount
+				writer.sequence = file.sequence
+				recovered = true
+			} else {
+				// 新文件可能与其同名，需要先同步结束
+				finishTempFile(file.tempFilename, file.lastPacketTime, w.encryption, w.syncOnClose)
+			}
+		}
+	}
 	if log.IsEnabledFor(logging.DEBUG) {
 		log.Debugf("Begin to write packets to %s", writer.tempFilename)
 	}
-	var err error
-	if writer.Writer, err = NewWriter(writer.tempFilename, w.writerBufferSize, w.tcpipChecksum); err != nil {
+	if w.dryRun {
+		writer.Writer = NewDryRunWriter(writer.tempFilename, w.writerBufferSize, w.snaplen, linkType, w.tcpipChecksum)
+		w.openExtraWriters(writer, false)
+		w.enableMonotonicTimestamp(writer)
+		atomic.AddUint64(&w.FileCreations, 1)
+		w.addWriterCount(aclGID, 1)
+		w.events.log(EVENT_FILE_CREATE, tapType, aclGID, nil, writer.tempFilename, nil)
+		return writer
+	}
+	err := w.createFile(writer, linkType)
+	w.updateCreateBackoff(err)
+	if err != nil {
 		if log.IsEnabledFor(logging.DEBUG) {
 			log.Debugf("Failed to create writer for %s: %s", writer.tempFilename, err)
 		}
-		w.FileCreationFailures++
+		atomic.AddUint64(&w.FileCreationFailures, 1)
+		w.events.log(EVENT_FILE_CREATE_FAILED, tapType, aclGID, nil, writer.tempFilename, err)
 		return nil
 	}
-	w.FileCreations++
+	w.openExtraWriters(writer, recovered)
+	w.enableMonotonicTimestamp(writer)
+	if recovered {
+		log.Infof("Continue writing packets to %s", writer.tempFilename)
+		writer.size = writer.FileSize()
+		atomic.AddUint64(&w.RecoveredFiles, 1)
+	} else {
+		atomic.AddUint64(&w.FileCreations, 1)
+	}
+	w.addWriterCount(aclGID, 1)
+	w.events.log(EVENT_FILE_CREATE, tapType, aclGID, nil, writer.tempFilename, nil)
 	return writer
 }
 
+func (w *Worker) createFile(writer *WrappedWriter, linkType layers.LinkType) (err error) {
+	directory := filepath.Dir(writer.tempFilename)
+	if _, err = os.Stat(directory); os.IsNotExist(err) {
+		if err = mkdirAll(directory, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	writer.Writer, err = createWriter(writer.tempFilename, w.writerBufferSize, w.snaplen, linkType, w.tcpipChecksum)
+	return err
+}
+
+// isCreationBackingOff returns true within the backoff after a creation failure,
+// the first file needed after it retries the creation
+func (w *Worker) isCreationBackingOff() bool {
+	if w.createRetryTime.IsZero() {
+		return false
+	}
+	if time.Now().Before(w.createRetryTime) {
+		return true
+	}
+	w.createRetryTime = time.Time{}
+	atomic.AddUint64(&w.CreationRetries, 1)
+	return false
+}
+
+// updateCreateBackoff pauses file creation after a failure, such as transient
+// errors of NFS, for createRetryBackoff doubled after each consecutive failure
+// up to createRetries times. Files are created with writersLock held, so the
+// worker never sleeps to retry but drops the packets needing a new file.
+func (w *Worker) updateCreateBackoff(err error) {
+	if err == nil {
+		w.createFailures = 0
+		return
+	}
+	if w.createRetries <= 0 {
+		return
+	}
+	backoff := w.createRetryBackoff << w.createFailures
+	if w.createFailures < w.createRetries-1 {
+		w.createFailures++
+	}
+	if log.IsEnabledFor(logging.DEBUG) {
+		log.Debugf("Create pcap file failed, retry in %s: %s", backoff, err)
+	}
+	w.createRetryTime = time.Now().Add(backoff)
+}
+
+// enableMonotonicTimestamp is called after all writers of a capture are opened,
+// lastPacketTime is the first packet of a new capture or the last record of a
+// recovered one
+func (w *Worker) enableMonotonicTimestamp(writer *WrappedWriter) {
+	if !w.monotonicTimestamp {
+		return
+	}
+	writer.SetMonotonicTimestamp(writer.lastPacketTime)
+	for _, extra := range writer.extraWriters {
+		extra.SetMonotonicTimestamp(writer.lastPacketTime)
+	}
+}
+
 func (w *Worker) cleanTimeoutFile(timeNow time.Duration) {
+	if w.recoverable != nil {
+		for _, file := range w.recoverable.takeExpired(timeNow, w.maxFilePeriod) {
+			file := file
+			w.finish(func() { finishTempFile(file.tempFilename, file.lastPacketTime, w.encryption, w.syncOnClose) })
+		}
+	}
 	for i := datatype.TAP_MIN; i < datatype.TAP_MAX; i++ {
 		for key, writer := range w.writers[i] {
 			if timeNow-writer.firstPacketTime > w.maxFilePeriod {
-				newFilename := writer.getFilename(w.baseDirectory)
-				w.finishWriter(writer, newFilename)
-				delete(w.writers[i], key)
+				w.closeWriter(zerodoc.TAPTypeEnum(i), key, writer)
+			} else if w.idleTimeout > 0 && timeNow-writer.lastPacketTime > w.idleTimeout {
+				// 长时间没有新包的文件提前结束，释放文件句柄并尽早可供下载
+				w.closeWriter(zerodoc.TAPTypeEnum(i), key, writer)
+				atomic.AddUint64(&w.IdleCloses, 1)
 			}
 		}
 	}
+	w.pruneRings(timeNow)
+	w.drainOverflow()
+}
+
+// adjustWriterBufferSize sizes the buffers of new files to hold about a second
+// of the average throughput of each file, bounded by min/maxWriterBufferSize,
+// files already opened keep their buffers
+func (w *Worker) adjustWriterBufferSize(now time.Time) {
+	if w.maxWriterBufferSize == 0 {
+		return
+	}
+	elapsed := now.Sub(w.bufferAdjustTime)
+	if elapsed < BUFFER_SIZE_ADJUST_INTERVAL {
+		return
+	}
+	writtenBytes := atomic.LoadUint64(&w.WrittenBytes)
+	if !w.bufferAdjustTime.IsZero() {
+		files := w.WriterCount()
+		if files < 1 {
+			files = 1
+		}
+		rate := float64(writtenBytes-w.bufferAdjustBytes) / elapsed.Seconds() / float64(files)
+		size := w.minWriterBufferSize
+		for size < w.maxWriterBufferSize && float64(size) < rate {
+			size <<= 1
+		}
+		if size > w.maxWriterBufferSize {
+			size = w.maxWriterBufferSize
+		}
+		if size != w.writerBufferSize {
+			log.Debugf("pcap worker %d changes buffer size of new files from %d to %d, %.0f bytes/s per file", w.index, w.writerBufferSize, size, rate)
+			w.writerBufferSize = size
+			atomic.StoreUint64(&w.WriterBufferSize, uint64(size))
+		}
+	}
+	w.bufferAdjustTime, w.bufferAdjustBytes = now, writtenBytes
 }
 
 func (w *Worker) toZerodocTAPType(packet *datatype.MetaPacket) zerodoc.TAPTypeEnum {
@@ -258,71 +1341,207 @@ func (w *Worker) toZerodocTAPType(packet *datatype.MetaPacket) zerodoc.TAPTypeEn
 	return zerodoc.CLOUD
 }
 
+// dropInvalidPacket counts packets with nil EndpointData, and logs at most once
+// per INVALID_PACKET_LOG_INTERVAL to avoid flooding logs with a burst of them
+func (w *Worker) dropInvalidPacket(packet *datatype.MetaPacket) {
+	invalidPackets := atomic.AddUint64(&w.InvalidPackets, 1)
+	if now := time.Now(); now.Sub(w.invalidPacketLogTime) >= INVALID_PACKET_LOG_INTERVAL {
+		log.Warningf("drop %d invalid packets with nil EndpointData since last log, the latest one is %v", invalidPackets-w.invalidPacketsLogged, packet)
+		w.invalidPacketLogTime = now
+		w.invalidPacketsLogged = invalidPackets
+	}
+}
+
+func (w *Worker) processPacket(packet *datatype.MetaPacket) {
+	if !packet.EndpointData.Valid() { // shouldn't happen
+		w.dropInvalidPacket(packet)
+		return
+	}
+	if packet.TapType >= datatype.TAP_MAX { // zerodoc.TAPTypeEnum只有8位，超出范围会被截断
+		atomic.AddUint64(&w.InvalidTapTypePackets, 1)
+		if !w.invalidTapTypeLogged {
+			log.Warningf("drop packets with invalid tap type %d, further occurrences are only counted", packet.TapType)
+			w.invalidTapTypeLogged = true
+		}
+		return
+	}
+
+	if packet.Timestamp > w.newestPacketTime {
+		w.newestPacketTime = packet.Timestamp
+	}
+
+	tapType := w.toZerodocTAPType(packet)
+	for _, policy := range packet.PolicyData.NpbActions {
+		// NOTICE: PCAP存储必须满足TunnelType是NPB_TUNNEL_TYPE_PCAP, 因为策略是NPB_TUNNEL_TYPE_PCAP类型，这里的判断去掉了
+		if policy.TunnelGid() <= 0 || !w.routePacket(packet, tapType, policy) {
+			continue
+		}
+		w.writePacket(packet, tapType, policy.TunnelGid())
+	}
+}
+
 func (w *Worker) Process() {
-	elements := make([]interface{}, QUEUE_BATCH_SIZE)
+	w.ProcessContext(context.Background())
+}
+
+// ProcessContext also exits if ctx is canceled, which is checked between
+// packets, the packets not processed yet are released
+func (w *Worker) ProcessContext(ctx context.Context) {
+	done := ctx.Done()
+	elements := make([]interface{}, w.queueBatchSize)
 
 WORKING_LOOP:
-	for !w.exiting {
+	for !w.isExiting() {
 		n := w.packetQueue.Gets(elements)
-		timeNow := time.Duration(time.Now().UnixNano())
-		for _, e := range elements[:n] {
+		now := time.Now()
+		w.updateIdleBackoff(elements[:n])
+		for i, e := range elements[:n] {
 			if e == nil { // tick
-				if w.exiting {
+				if w.isExiting() || isCanceled(done) {
+					releaseElements(elements[i+1 : n])
 					break WORKING_LOOP
 				}
-				w.cleanTimeoutFile(timeNow)
-				continue
-			}
-
-			block := e.(*datatype.MetaPacketBlock)
-
-			for i := uint8(0); i < block.Count; i++ {
-				packet := &block.Metas[i]
-
-				if !packet.EndpointData.Valid() { // shouldn't happen
-					log.Warningf("drop invalid packet with nil EndpointData %v", packet)
+				if w.skipSweep(now) {
 					continue
 				}
-
-				tapType := w.toZerodocTAPType(packet)
-				for _, policy := range packet.PolicyData.NpbActions {
-					// NOTICE: PCAP存储必须满足TunnelType是NPB_TUNNEL_TYPE_PCAP, 因为策略是NPB_TUNNEL_TYPE_PCAP类型，这里的判断去掉了
-					if policy.TunnelGid() <= 0 {
-						continue
-					}
-					w.writePacket(packet, tapType, policy.TunnelGid())
-				}
+				w.writersLock.Lock()
+				w.cleanTimeoutFile(w.tickTime(now))
+				w.writersLock.Unlock()
+				w.adjustWriterBufferSize(now)
+				continue
 			}
 
-			datatype.ReleaseMetaPacketBlock(block)
+			if !w.processBlock(e.(*datatype.MetaPacketBlock), done) {
+				releaseElements(elements[i+1 : n])
+				break WORKING_LOOP
+			}
 		}
 	}
 
+	w.writersLock.Lock()
 	for i := datatype.TAP_MIN; i < datatype.TAP_MAX; i++ {
-		for _, writer := range w.writers[i] {
-			newFilename := writer.getFilename(w.baseDirectory)
-			w.finishWriter(writer, newFilename)
+		for key, writer := range w.writers[i] {
+			w.closeWriter(zerodoc.TAPTypeEnum(i), key, writer)
 		}
 	}
+	w.dropOverflow()
+	w.writersLock.Unlock()
+	if w.finisher != nil {
+		w.finisher.close()
+	}
 	log.Infof("Stopped pcap worker (%d)", w.index)
-	w.exitWg.Done()
+	close(w.stopped)
+}
+
+func isCanceled(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseElements(elements []interface{}) {
+	for _, e := range elements {
+		if e != nil {
+			datatype.ReleaseMetaPacketBlock(e.(*datatype.MetaPacketBlock))
+		}
+	}
+}
+
+// processBlock returns false if done is closed before all packets are processed,
+// the block is released in both cases
+func (w *Worker) processBlock(block *datatype.MetaPacketBlock, done <-chan struct{}) bool {
+	completed := true
+	w.writersLock.Lock()
+	for i := uint8(0); i < block.Count; i++ {
+		if isCanceled(done) {
+			completed = false
+			break
+		}
+		w.processPacket(&block.Metas[i])
+	}
+	w.writersLock.Unlock()
+	if w.router != nil {
+		if overwrites := w.router.flushAll(); overwrites > 0 {
+			atomic.AddUint64(&w.ForwardOverwrites, overwrites)
+		}
+	}
+
+	datatype.ReleaseMetaPacketBlock(block)
+	return completed
 }
 
+// Close waits for Process to finish all files, and gives up after closeTimeout
+// if set, leaving the temp files to be finished on the next start
 func (w *Worker) Close() error {
-	log.Infof("Stop pcap worker (%d) writing to %d files", w.index, len(w.writers))
-	w.exitWg.Add(1)
-	w.exiting = true
-	w.exitWg.Wait()
-	w.exited = true
-	return nil
+	log.Infof("Stop pcap worker (%d) writing to %d files", w.index, w.WriterCount())
+	atomic.StoreInt32(&w.exiting, 1)
+	if w.closeTimeout <= 0 {
+		<-w.stopped
+		atomic.StoreInt32(&w.exited, 1)
+		return nil
+	}
+
+	select {
+	case <-w.stopped:
+		atomic.StoreInt32(&w.exited, 1)
+		return nil
+	case <-time.After(w.closeTimeout):
+		atomic.StoreInt32(&w.stuck, 1)
+		return fmt.Errorf("pcap worker (%d) doesn't exit in %s, its temp files are left", w.index, w.closeTimeout)
+	}
+}
+
+func (w *Worker) addWriterCounter(counter *WriterCounter) {
+	atomic.AddUint64(&w.BufferedCount, counter.totalBufferedCount)
+	atomic.AddUint64(&w.WrittenCount, counter.totalWrittenCount)
+	atomic.AddUint64(&w.BufferedBytes, counter.totalBufferedBytes)
+	atomic.AddUint64(&w.WrittenBytes, counter.totalWrittenBytes)
+	atomic.AddUint64(&w.ReorderedPackets, counter.totalReorderedCount)
 }
 
+// GetCounter returns the increments since the last call, it's only called by stats
 func (w *Worker) GetCounter() interface{} {
-	counter := &WorkerCounter{}
-	counter, w.WorkerCounter = w.WorkerCounter, counter
-	return counter
+	snapshot := w.Snapshot()
+	counter := snapshot
+	counter.sub(&w.reportedCounter)
+	w.reportedCounter = snapshot
+	return &counter
+}
+
+// Snapshot returns the counters accumulated since the worker is created without
+// resetting them, it's safe to be called concurrently with Process
+func (w *Worker) Snapshot() WorkerCounter {
+	return w.WorkerCounter.load()
 }
 
+func (w *Worker) addWriterCount(aclGID uint16, delta int) {
+	atomic.AddInt64(&w.writerCount, int64(delta))
+	if w.maxFilesPerAclGID > 0 {
+		if count := w.aclGIDWriterCount[aclGID] + delta; count > 0 {
+			w.aclGIDWriterCount[aclGID] = count
+		} else {
+			delete(w.aclGIDWriterCount, aclGID)
+		}
+	}
+}
+
+func (w *Worker) WriterCount() int {
+	return int(atomic.LoadInt64(&w.writerCount))
+}
+
+// Closed returns true if the worker is closed, or Process exits as its context is canceled
 func (w *Worker) Closed() bool {
-	return w.exited
+	return atomic.LoadInt32(&w.exited) == 1 || isCanceled(w.stopped)
+}
+
+func (w *Worker) isExiting() bool {
+	return atomic.LoadInt32(&w.exiting) == 1
+}
+
+// Stuck returns true if Close timed out, Process may be still running
+func (w *Worker) Stuck() bool {
+	return atomic.LoadInt32(&w.stuck) == 1
 }
@@ -0,0 +1,367 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func newTestWorker(t *testing.T, options ...Option) *Worker {
+	m := NewWorkerManager([]queue.QueueReader{nil}, nil, false, 64, 1000, 25, 300, 100, 10, t.TempDir(), options...)
+	return m.newWorker(0)
+}
+
+func newPolicyPacket(timestamp time.Duration, size int, aclGID uint32) *datatype.MetaPacket {
+	packet := newRawPacket(timestamp, size)
+	packet.TapType = datatype.TAP_CLOUD
+	packet.EndpointData.SrcInfo = &datatype.EndpointInfo{}
+	packet.PolicyData.NpbActions = []datatype.NpbActions{datatype.ToNpbActions(aclGID, 0, datatype.NPB_TUNNEL_TYPE_PCAP, 0, 0)}
+	return packet
+}
+
+// countPackets returns the number of files matching pattern and the packets in them
+func countPackets(t *testing.T, pattern string) (int, int) {
+	files, _ := filepath.Glob(pattern)
+	packets := 0
+	for _, file := range files {
+		reader, err := OpenReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := reader.Next(); err != nil {
+				break
+			}
+			packets++
+		}
+		reader.Close()
+	}
+	return len(files), packets
+}
+
+func TestTapTypeToString(t *testing.T) {
+	if s := tapTypeToString(zerodoc.CLOUD); s != "tor" {
+		t.Errorf("expected tor, got %s", s)
+	}
+	for i := 0; i <= 255; i++ {
+		if tapTypeToString(zerodoc.TAPTypeEnum(i)) == "" {
+			t.Errorf("empty string for tap type %d", i)
+		}
+	}
+}
+
+func TestInvalidTapType(t *testing.T) {
+	w := newTestWorker(t)
+	for _, tapType := range []datatype.TapType{datatype.TAP_MAX, datatype.TAP_MAX + 3, ^datatype.TapType(0)} {
+		packet := newPolicyPacket(time.Second, 64, 1)
+		packet.TapType = tapType
+		w.processPacket(packet)
+	}
+	if w.InvalidTapTypePackets != 3 || w.FileCreations != 0 {
+		t.Errorf("expected 3 invalid packets and no files, got %d and %d", w.InvalidTapTypePackets, w.FileCreations)
+	}
+	w.processPacket(newPolicyPacket(time.Second, 64, 1))
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 1 || packets != 1 {
+		t.Errorf("valid packet should be written after invalid ones, got %d files and %d packets", files, packets)
+	}
+}
+
+func TestInvalidPackets(t *testing.T) {
+	w := newTestWorker(t)
+	for i := 0; i < 3; i++ {
+		packet := newPolicyPacket(time.Second, 64, 1)
+		packet.EndpointData.SrcInfo = nil
+		w.processPacket(packet)
+	}
+	// 只有第一个包打印日志
+	if w.invalidPacketsLogged != 1 {
+		t.Errorf("expected the first invalid packet logged, got %d", w.invalidPacketsLogged)
+	}
+	counter := w.GetCounter().(*WorkerCounter)
+	if counter.InvalidPackets != 3 || counter.FileCreations != 0 {
+		t.Errorf("expected 3 invalid packets and no files, got %d and %d", counter.InvalidPackets, counter.FileCreations)
+	}
+	if counter = w.GetCounter().(*WorkerCounter); counter.InvalidPackets != 0 {
+		t.Errorf("expected no invalid packets since last GetCounter, got %d", counter.InvalidPackets)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	w := newTestWorker(t, OptionDryRun(true), OptionMaxPacketsPerFile(2))
+	for i := 0; i < 5; i++ {
+		w.writePacket(newRawPacket(time.Duration(i)*time.Millisecond, 100), zerodoc.CLOUD, 1)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if w.FileCreations != 3 || w.FileCloses != 3 {
+		t.Errorf("expected 3 creations and closes, got %d and %d", w.FileCreations, w.FileCloses)
+	}
+	if expected := uint64(3*GLOBAL_HEADER_LEN + 5*(RECORD_HEADER_LEN+100)); w.WrittenBytes != expected {
+		t.Errorf("expected %d written bytes, got %d", expected, w.WrittenBytes)
+	}
+	if entries, _ := os.ReadDir(w.baseDirectory); len(entries) != 0 {
+		t.Errorf("nothing should be created in dry-run mode, got %v", entries)
+	}
+}
+
+func TestDropOversizedPackets(t *testing.T) {
+	w := newTestWorker(t, OptionMaxPacketSize(1000), OptionDropOversizedPackets(true))
+	w.writePacket(newRawPacket(time.Second, 2000), zerodoc.CLOUD, 1)
+	if w.OversizedPackets != 1 || w.FileCreations != 0 {
+		t.Errorf("oversized packet should be dropped, got %d oversized and %d files", w.OversizedPackets, w.FileCreations)
+	}
+	w.writePacket(newRawPacket(time.Second, 1000), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); w.OversizedPackets != 1 || files != 1 || packets != 1 {
+		t.Errorf("packet within the limit should be written, got %d files and %d packets", files, packets)
+	}
+
+	w = newTestWorker(t, OptionMaxPacketSize(1000))
+	w.writePacket(newRawPacket(time.Second, 2000), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if w.OversizedPackets != 1 || len(files) != 1 {
+		t.Fatalf("oversized packet should be truncated and written, got %d oversized and files %v", w.OversizedPackets, files)
+	}
+	if records, err := readAll(t, files[0]); err != nil || len(records) != 1 || len(records[0].Data) != 1000 || records[0].OrigLen != 2000 {
+		t.Errorf("expected 1 record truncated to 1000 bytes: %v", err)
+	}
+
+	// 没有RawHeader的包按转换后的长度判断
+	w = newTestWorker(t, OptionMaxPacketSize(40), OptionDropOversizedPackets(true))
+	packet := &datatype.MetaPacket{Timestamp: time.Second, PacketLen: 1500, EthType: layers.EthernetTypeIPv4, Protocol: layers.IPProtocolTCP}
+	packet.TcpData.DataOffset = 5
+	w.writePacket(packet, zerodoc.CLOUD, 1)
+	if w.OversizedPackets != 1 || w.FileCreations != 0 {
+		t.Errorf("converted packet longer than snaplen should be dropped, got %d oversized and %d files", w.OversizedPackets, w.FileCreations)
+	}
+	if w = newTestWorker(t); w.snaplen != SNAPLEN {
+		t.Errorf("snaplen should be %d by default, got %d", SNAPLEN, w.snaplen)
+	}
+}
+
+func TestMixedIPv4AndIPv6Writers(t *testing.T) {
+	ipv4 := newRawPacket(time.Second, 64)
+	ipv4.EthType = layers.EthernetTypeIPv4
+	ipv4.Protocol = layers.IPProtocolTCP
+	ipv4.IpSrc, ipv4.IpDst = 0x0a000001, 0x0a000002
+	ipv4.PortSrc, ipv4.PortDst = 1234, 80
+	// IPv4映射地址与IPv4流的元组字节相同，但不能写入同一个文件
+	ipv6 := *ipv4
+	ipv6.EthType = layers.EthernetTypeIPv6
+	ipv6.Ip6Src = net.ParseIP("::a00:1")
+	ipv6.Ip6Dst = net.ParseIP("::a00:2")
+	ipv6Reply := ipv6
+	ipv6Reply.Ip6Src, ipv6Reply.Ip6Dst = ipv6.Ip6Dst, ipv6.Ip6Src
+	ipv6Reply.PortSrc, ipv6Reply.PortDst = ipv6.PortDst, ipv6.PortSrc
+
+	w := newTestWorker(t, OptionWriterKeyMode(WRITER_KEY_BY_FLOW))
+	for _, packet := range []*datatype.MetaPacket{ipv4, &ipv6, &ipv6Reply, ipv4} {
+		w.writePacket(packet, zerodoc.CLOUD, 1)
+	}
+	if len(w.writers[zerodoc.CLOUD]) != 2 || w.FileCreations != 2 {
+		t.Fatalf("expected 2 writers for IPv4 and IPv6 flows, got %d writers and %d creations", len(w.writers[zerodoc.CLOUD]), w.FileCreations)
+	}
+	for _, writer := range w.writers[zerodoc.CLOUD] {
+		if writer.packetCount != 2 {
+			t.Errorf("unexpected packet count %d of %s", writer.packetCount, writer.flowName)
+		}
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if len(w.writers[zerodoc.CLOUD]) != 0 || w.FileCloses != 2 || w.WriterCount() != 0 {
+		t.Errorf("all writers should be closed, got %d closes", w.FileCloses)
+	}
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 2 || packets != 4 {
+		t.Errorf("expected 4 packets in 2 files, got %d packets in %d files", packets, files)
+	}
+
+	// 按采集口区分文件时，IPv4与IPv6共用同一个文件，不同采集器不共用
+	w = newTestWorker(t)
+	otherVtap := ipv6
+	otherVtap.VtapId = 2
+	for _, packet := range []*datatype.MetaPacket{ipv4, &ipv6, &otherVtap} {
+		w.writePacket(packet, zerodoc.CLOUD, 1)
+	}
+	if len(w.writers[zerodoc.CLOUD]) != 2 {
+		t.Errorf("expected 2 writers for 2 vtaps, got %d", len(w.writers[zerodoc.CLOUD]))
+	}
+}
+
+func TestSkipTinyPackets(t *testing.T) {
+	// 默认不按长度跳过
+	w := newTestWorker(t)
+	w.writePacket(newRawPacket(time.Second, 10), zerodoc.CLOUD, 1)
+	if w.SkippedTinyPackets != 0 || w.FileCreations != 1 {
+		t.Errorf("packets should not be skipped by default, got %d skipped and %d files", w.SkippedTinyPackets, w.FileCreations)
+	}
+
+	w = newTestWorker(t, OptionMinPacketSize(14))
+	w.writePacket(newRawPacket(time.Second, 0), zerodoc.CLOUD, 1)
+	if w.SkippedTinyPackets != 1 || w.FileCreations != 0 || w.BufferedCount != 0 {
+		t.Errorf("zero-length packet should be skipped, got %d skipped and %d records", w.SkippedTinyPackets, w.BufferedCount)
+	}
+
+	w = newTestWorker(t, OptionMinPacketSize(64))
+	w.writePacket(newRawPacket(time.Second, 63), zerodoc.CLOUD, 1)
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if w.SkippedTinyPackets != 1 || len(files) != 1 {
+		t.Fatalf("expected 1 skipped packet and 1 file, got %d and %v", w.SkippedTinyPackets, files)
+	}
+	if records, err := readAll(t, files[0]); err != nil || len(records) != 1 || len(records[0].Data) != 64 {
+		t.Errorf("expected only the 64-byte packet written: %v", err)
+	}
+}
+
+func TestMonotonicTimestamp(t *testing.T) {
+	w := newTestWorker(t, OptionMonotonicTimestamp(true))
+	for _, second := range []time.Duration{2, 1, 3} {
+		w.writePacket(newRawPacket(second*time.Second, 64), zerodoc.CLOUD, 1)
+	}
+	for _, writer := range w.writers[zerodoc.CLOUD] {
+		if writer.lastPacketTime != 3*time.Second {
+			t.Errorf("expected last packet time 3s, got %s", writer.lastPacketTime)
+		}
+	}
+	if w.ReorderedPackets != 1 {
+		t.Errorf("expected 1 reordered packet, got %d", w.ReorderedPackets)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %v", files)
+	}
+	records, err := readAll(t, files[0])
+	if err != nil || len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d: %v", len(records), err)
+	}
+	// 乱序的包使用前一个记录的时间
+	for i, expected := range []time.Duration{2, 2, 3} {
+		if records[i].Timestamp != expected*time.Second {
+			t.Errorf("expected record %d at %ds, got %s", i, expected, records[i].Timestamp)
+		}
+	}
+}
+
+func TestTruncatePartialRecordOnClose(t *testing.T) {
+	w := newTestWorker(t)
+	restore := limitFileSize(t, GLOBAL_HEADER_LEN+2*(RECORD_HEADER_LEN+100)+50)
+	for i := 1; i <= 3; i++ {
+		w.writePacket(newRawPacket(time.Duration(i)*time.Second, 100), zerodoc.CLOUD, 1)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	restore()
+	if w.TruncatedFiles != 1 || w.FileCloses != 1 {
+		t.Fatalf("expected 1 truncated file, got %d truncated %d closed", w.TruncatedFiles, w.FileCloses)
+	}
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %v", files)
+	}
+	if records, err := readAll(t, files[0]); err != nil || len(records) != 2 {
+		t.Errorf("expected 2 complete records, got %d: %v", len(records), err)
+	}
+
+	// 截断失败时隔离文件而不是重命名
+	truncate = func(string, int64) error { return syscall.EIO }
+	defer func() { truncate = os.Truncate }()
+	w = newTestWorker(t)
+	restore = limitFileSize(t, GLOBAL_HEADER_LEN+RECORD_HEADER_LEN+50)
+	w.writePacket(newRawPacket(time.Second, 100), zerodoc.CLOUD, 1)
+	w.cleanTimeoutFile(time.Hour)
+	restore()
+	if w.FileCloses != 0 {
+		t.Error("file with a partial record should not be finished")
+	}
+	if files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*"+TEMP_SUFFIX+QUARANTINE_SUFFIX)); len(files) != 1 {
+		t.Errorf("expected 1 quarantined file, got %v", files)
+	}
+}
+
+func TestCounterSnapshot(t *testing.T) {
+	w := newTestWorker(t, OptionDryRun(true), OptionMaxPacketsPerFile(10))
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 1)
+		}
+		close(done)
+	}()
+
+	var reported uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		reported += w.GetCounter().(*WorkerCounter).FileCreations
+		if snapshot := w.Snapshot(); snapshot.FileCreations < reported {
+			t.Fatalf("snapshot %d is less than reported %d", snapshot.FileCreations, reported)
+		}
+	}
+	reported += w.GetCounter().(*WorkerCounter).FileCreations
+	if snapshot := w.Snapshot(); snapshot.FileCreations != 100 || reported != 100 {
+		t.Errorf("expected 100 file creations, got %d in snapshot and %d reported", snapshot.FileCreations, reported)
+	}
+}
+
+func TestAdaptiveWriterBufferSize(t *testing.T) {
+	w := newTestWorker(t, OptionMaxPacketSize(1500), OptionMinBlockSizeKB(4), OptionMaxBlockSizeKB(256))
+	if w.minWriterBufferSize != 4<<10 || w.writerBufferSize != 64<<10 {
+		t.Fatalf("unexpected buffer sizes %d and %d", w.minWriterBufferSize, w.writerBufferSize)
+	}
+	now := time.Now()
+	w.adjustWriterBufferSize(now)
+	// 低流量时缩小到下限
+	now = now.Add(BUFFER_SIZE_ADJUST_INTERVAL)
+	w.adjustWriterBufferSize(now)
+	if w.writerBufferSize != 4<<10 || w.Snapshot().WriterBufferSize != 4<<10 {
+		t.Errorf("expected buffer size shrunk to 4KB, got %d", w.writerBufferSize)
+	}
+	// 每秒20KB时选择不小于它的最小2的幂
+	w.WrittenBytes += 20 << 10 * uint64(BUFFER_SIZE_ADJUST_INTERVAL/time.Second)
+	now = now.Add(BUFFER_SIZE_ADJUST_INTERVAL)
+	w.adjustWriterBufferSize(now)
+	if w.writerBufferSize != 32<<10 {
+		t.Errorf("expected buffer size 32KB, got %d", w.writerBufferSize)
+	}
+	w.WrittenBytes += 100 << 20
+	now = now.Add(BUFFER_SIZE_ADJUST_INTERVAL)
+	w.adjustWriterBufferSize(now)
+	if w.writerBufferSize != 256<<10 {
+		t.Errorf("expected buffer size bounded by 256KB, got %d", w.writerBufferSize)
+	}
+	w.writePacket(newRawPacket(time.Second, 1500), zerodoc.CLOUD, 1)
+	for _, writer := range w.writers[zerodoc.CLOUD] {
+		if writer.bufferSize != 256<<10 {
+			t.Errorf("new file should use the adjusted buffer size, got %d", writer.bufferSize)
+		}
+	}
+}
@@ -18,8 +18,12 @@ package pcap
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
 
 	"github.com/deepflowio/deepflow/server/libs/datatype"
 )
@@ -29,10 +33,11 @@ const (
 )
 
 type WriterCounter struct {
-	totalBufferedCount uint64
-	totalWrittenCount  uint64
-	totalBufferedBytes uint64
-	totalWrittenBytes  uint64
+	totalBufferedCount  uint64
+	totalWrittenCount   uint64
+	totalBufferedBytes  uint64
+	totalWrittenBytes   uint64
+	totalReorderedCount uint64
 }
 
 type Writer struct {
@@ -45,26 +50,85 @@ type Writer struct {
 	flushed    *sync.WaitGroup
 	offset     int
 
-	fileSize int64
+	// fileSize和写入统计由backgroundFlush更新，同时可能被FileSize和GetStats读取
+	statsLock sync.Mutex
+	fileSize  int64
+	flushErr  error // set by backgroundFlush, read after flushed.Wait()
+
+	// 写入中途失败时文件可能以不完整的记录结尾，与flushErr一样在flushed.Wait()后读取
+	partialRecord bool
+	goodSize      int64 // file size at the last record boundary if partialRecord
 
+	snaplen       int
+	linkType      layers.LinkType
 	tcpipChecksum bool
 
+	monotonicTimestamp bool
+	lastTimestamp      time.Duration
+
 	WriterCounter
 }
 
-func NewWriter(filename string, bufferSize int, tcpipChecksum bool) (*Writer, error) {
+// writeFile is replaced in tests to simulate partial writes
+var writeFile = (*os.File).Write
+
+// getSnaplen limits snaplen to SNAPLEN, which is advertised in the global header
+func getSnaplen(snaplen int) int {
+	if snaplen <= 0 || snaplen > SNAPLEN {
+		snaplen = SNAPLEN
+	}
+	return snaplen
+}
+
+// getBufferSize enlarges bufferSize to hold the largest record of snaplen, the
+// snaplen in the global header doesn't change with the buffer size
+func getBufferSize(bufferSize, snaplen int) int {
+	maxRecordSize := RECORD_HEADER_LEN + snaplen
+	if snaplen < MAX_HEADER_LEN {
+		// 转换的包先完整写入缓冲区再截断
+		maxRecordSize = RECORD_HEADER_LEN + MAX_HEADER_LEN
+	}
+	if bufferSize < maxRecordSize {
+		return maxRecordSize
+	}
+	return bufferSize
+}
+
+func newWriter(bufferSize, snaplen int, linkType layers.LinkType, tcpipChecksum bool) *Writer {
 	writer := &Writer{}
+	writer.snaplen = getSnaplen(snaplen)
+	bufferSize = getBufferSize(bufferSize, writer.snaplen)
 	writer.bufferSize = bufferSize
+	writer.linkType = linkType
 	writer.buffer[0] = make([]byte, bufferSize)
 	writer.buffer[1] = make([]byte, bufferSize)
 	writer.flushed = &sync.WaitGroup{}
 	writer.tcpipChecksum = tcpipChecksum
+	return writer
+}
+
+// linkType is recorded in the global header, packets without RawHeader are
+// always converted to Ethernet frames, so it should be LinkTypeEthernet for them
+func NewWriter(filename string, bufferSize, snaplen int, linkType layers.LinkType, tcpipChecksum bool) (*Writer, error) {
+	writer := newWriter(bufferSize, snaplen, linkType, tcpipChecksum)
 	if err := writer.init(filename); err != nil {
 		return nil, err
 	}
 	return writer, nil
 }
 
+// NewDryRunWriter formats packets like NewWriter but discards them instead of
+// writing to a file, so that sizes and counters are the same as a real capture
+func NewDryRunWriter(filename string, bufferSize, snaplen int, linkType layers.LinkType, tcpipChecksum bool) *Writer {
+	writer := newWriter(bufferSize, snaplen, linkType, tcpipChecksum)
+	writer.filename = filename
+	NewGlobalHeader(writer.buffer[writer.latch], uint32(writer.snaplen), writer.linkType)
+	writer.offset = GLOBAL_HEADER_LEN
+	writer.totalBufferedCount++
+	writer.totalBufferedBytes += GLOBAL_HEADER_LEN
+	return writer
+}
+
 func (w *Writer) init(filename string) error {
 	w.filename = filename
 	isNewFile := false
@@ -74,6 +138,7 @@ func (w *Writer) init(filename string) error {
 		if stat.Size() == 0 {
 			isNewFile = true
 		}
+		w.fileSize = stat.Size()
 	} else {
 		return err
 	}
@@ -83,7 +148,7 @@ func (w *Writer) init(filename string) error {
 		if w.fp, err = os.Create(filename); err != nil {
 			return err
 		}
-		NewGlobalHeader(w.buffer[w.latch], SNAPLEN)
+		NewGlobalHeader(w.buffer[w.latch], uint32(w.snaplen), w.linkType)
 		w.offset = GLOBAL_HEADER_LEN
 		w.totalBufferedCount++
 		w.totalBufferedBytes += GLOBAL_HEADER_LEN
@@ -99,6 +164,9 @@ func (w *Writer) Write(packet *datatype.MetaPacket) error {
 	maxPacketSize := RECORD_HEADER_LEN + MAX_HEADER_LEN
 	if packet.RawHeaderSize > 0 {
 		maxPacketSize = RECORD_HEADER_LEN + int(packet.RawHeaderSize)
+		if int(packet.RawHeaderSize) > w.snaplen {
+			maxPacketSize = RECORD_HEADER_LEN + w.snaplen
+		}
 	}
 	if w.bufferSize-w.offset < maxPacketSize {
 		if err := w.Flush(); err != nil {
@@ -108,9 +176,29 @@ func (w *Writer) Write(packet *datatype.MetaPacket) error {
 
 	header := NewRecordHeader(w.buffer[w.latch][w.offset:])
 	w.offset += RECORD_HEADER_LEN
-	size := NewRawPacket(w.buffer[w.latch][w.offset:]).MetaPacketToRaw(packet, w.tcpipChecksum)
+	var size int
+	if int(packet.RawHeaderSize) > w.snaplen {
+		// 超过snaplen的包截断写入，orig_len保留原始长度
+		size = copy(w.buffer[w.latch][w.offset:], packet.RawHeader[:w.snaplen])
+	} else {
+		size = NewRawPacket(w.buffer[w.latch][w.offset:]).MetaPacketToRaw(packet, w.tcpipChecksum)
+		if size > w.snaplen {
+			// 转换出的头部也不能超过snaplen，多写的部分被后续记录覆盖
+			size = w.snaplen
+		}
+	}
 	w.offset += size
-	header.SetTimestamp(packet.Timestamp)
+	timestamp := packet.Timestamp
+	if w.monotonicTimestamp {
+		if timestamp < w.lastTimestamp {
+			// 乱序的包使用上一个包的时间，保证文件中的时间戳不减
+			timestamp = w.lastTimestamp
+			w.totalReorderedCount++
+		} else {
+			w.lastTimestamp = timestamp
+		}
+	}
+	header.SetTimestamp(timestamp)
 	header.SetOrigLen(int(packet.PacketLen))
 	header.SetInclLen(size)
 	w.totalBufferedCount++
@@ -118,62 +206,206 @@ func (w *Writer) Write(packet *datatype.MetaPacket) error {
 	return nil
 }
 
+// SetMonotonicTimestamp clamps the timestamp of a packet to that of the previous
+// record if it's smaller, lastTimestamp is the timestamp of the last record in
+// the file if appending to it
+func (w *Writer) SetMonotonicTimestamp(lastTimestamp time.Duration) {
+	w.monotonicTimestamp = true
+	w.lastTimestamp = lastTimestamp
+}
+
+func (w *Writer) Snaplen() int {
+	return w.snaplen
+}
+
+func (w *Writer) LinkType() layers.LinkType {
+	return w.linkType
+}
+
 func (w *Writer) BufferSize() int {
 	return w.offset
 }
 
 func (w *Writer) FileSize() int64 {
+	w.statsLock.Lock()
+	defer w.statsLock.Unlock()
 	return w.fileSize
 }
 
 func (w *Writer) GetStats() WriterCounter {
+	w.statsLock.Lock()
+	defer w.statsLock.Unlock()
 	return w.WriterCounter
 }
 
 func (w *Writer) ResetStats() {
+	w.statsLock.Lock()
+	w.resetStats()
+	w.statsLock.Unlock()
+}
+
+func (w *Writer) resetStats() {
 	w.totalBufferedCount = 0
 	w.totalWrittenCount = 0
 	w.totalBufferedBytes = 0
 	w.totalWrittenBytes = 0
+	w.totalReorderedCount = 0
 }
 
+// GetAndResetStats doesn't lose bytes written by a background flush in between
 func (w *Writer) GetAndResetStats() WriterCounter {
-	c := w.GetStats()
-	w.ResetStats()
+	w.statsLock.Lock()
+	defer w.statsLock.Unlock()
+	c := w.WriterCounter
+	w.resetStats()
 	return c
 }
 
+// addWritten is called by backgroundFlush for n bytes written, which are
+// counted as written records only if the write succeeds
+func (w *Writer) addWritten(n int, succeeded bool) {
+	w.statsLock.Lock()
+	w.fileSize += int64(n)
+	if succeeded {
+		w.totalWrittenCount++
+		w.totalWrittenBytes += uint64(n)
+	}
+	w.statsLock.Unlock()
+}
+
+func (w *Writer) setFileSize(size int64) {
+	w.statsLock.Lock()
+	w.fileSize = size
+	w.statsLock.Unlock()
+}
+
+// Sync flushes buffered records and commits the file content to stable storage
+func (w *Writer) Sync() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.flushed.Wait()
+	if w.fp == nil {
+		return nil
+	}
+	return w.fp.Sync()
+}
+
+// Close closes the file even if the buffered data fails to be flushed
 func (w *Writer) Close() error {
-	if w.offset != 0 {
-		if err := w.Flush(); err != nil {
-			return err
-		}
-		w.flushed.Wait()
+	err := w.Flush()
+	w.flushed.Wait()
+	if err == nil {
+		err = w.flushErr
+	}
+	if w.fp == nil {
+		return err
 	}
-	return w.fp.Close()
+	if closeErr := w.fp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func (w *Writer) Clear() {
 	w.offset = 0
 }
 
-func (w *Writer) backgroundFlush(latch, size int) error {
-	defer w.flushed.Done()
-	if n, err := w.fp.Write(w.buffer[latch][:size]); err != nil {
+func (w *Writer) backgroundFlush(latch, size int) (err error) {
+	defer func() {
+		w.flushErr = err
+		w.flushed.Done()
+	}()
+	if w.fp == nil { // dry run
+		w.addWritten(size, true)
+		return nil
+	}
+	if w.partialRecord {
+		// 先截掉不完整的记录，否则之后追加的记录全部错位
+		if err := w.truncatePartialRecord(); err != nil {
+			return err
+		}
+	}
+	// fileSize只在此处修改，本goroutine内读取无需加锁
+	start := w.fileSize
+	n, err := writeFile(w.fp, w.buffer[latch][:size])
+	w.addWritten(n, err == nil)
+	if err == nil && n != size {
+		err = fmt.Errorf("Flush(): not all bytes written to file %s", w.filename)
+	}
+	if err != nil && n > 0 && n < size {
+		// 缓冲区总是从记录边界开始，新文件则从global header开始
+		w.goodSize = start + int64(recordBoundary(w.buffer[latch][:n], start == 0))
+		w.partialRecord = w.goodSize != start+int64(n)
+	}
+	return err
+}
+
+// recordBoundary returns the length of the complete records at the beginning
+// of buffer, which is the prefix of a flushed buffer
+func recordBoundary(buffer []byte, withGlobalHeader bool) int {
+	boundary := 0
+	if withGlobalHeader {
+		if len(buffer) < GLOBAL_HEADER_LEN {
+			return 0
+		}
+		boundary = GLOBAL_HEADER_LEN
+	}
+	for boundary+RECORD_HEADER_LEN <= len(buffer) {
+		next := boundary + RECORD_HEADER_LEN + NewRecordHeader(buffer[boundary:]).InclLen()
+		if next > len(buffer) {
+			break
+		}
+		boundary = next
+	}
+	return boundary
+}
+
+// truncatePartialRecord drops the partial record at the end of the file, the
+// global header is rewritten if it's partial too
+func (w *Writer) truncatePartialRecord() error {
+	if err := w.fp.Truncate(w.goodSize); err != nil {
 		return err
-	} else {
-		w.fileSize += int64(n)
-		w.totalWrittenCount++
-		w.totalWrittenBytes += uint64(n)
-		if n != size {
-			return fmt.Errorf("Flush(): not all bytes written to file %s", w.filename)
+	}
+	if _, err := w.fp.Seek(w.goodSize, io.SeekStart); err != nil {
+		return err
+	}
+	w.setFileSize(w.goodSize)
+	w.partialRecord = false
+	if w.goodSize == 0 {
+		header := make([]byte, GLOBAL_HEADER_LEN)
+		NewGlobalHeader(header, uint32(w.snaplen), w.linkType)
+		n, err := writeFile(w.fp, header)
+		w.addWritten(n, false)
+		if err != nil {
+			w.goodSize, w.partialRecord = 0, n > 0
+			return err
 		}
 	}
 	return nil
 }
 
+// partialRecordTruncated is called after the file is truncated to the size
+// returned by PartialRecord
+func (w *Writer) partialRecordTruncated() {
+	w.setFileSize(w.goodSize)
+	w.partialRecord = false
+}
+
+// PartialRecord returns whether the file ends with a partially written record
+// and its size at the last record boundary, it's valid after Close
+func (w *Writer) PartialRecord() (int64, bool) {
+	return w.goodSize, w.partialRecord
+}
+
+// Flush returns the error of the last background flush if any, the buffered
+// data is not flushed in this case and the next call retries
 func (w *Writer) Flush() error {
 	w.flushed.Wait()
+	if err := w.flushErr; err != nil {
+		w.flushErr = nil
+		return err
+	}
 	if w.offset == 0 {
 		return nil
 	}
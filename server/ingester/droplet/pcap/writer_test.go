@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+func newRawPacket(timestamp time.Duration, size int) *datatype.MetaPacket {
+	raw := make([]byte, size)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	return &datatype.MetaPacket{
+		RawHeader:     raw,
+		RawHeaderSize: uint16(size),
+		PacketLen:     uint16(size),
+		Timestamp:     timestamp,
+	}
+}
+
+func TestWriterSync(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sync.pcap")
+	writer, err := NewWriter(filename, 1<<16, SNAPLEN, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(newRawPacket(time.Second, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != GLOBAL_HEADER_LEN+RECORD_HEADER_LEN+100 {
+		t.Errorf("file content not synced: %v %v", info, err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriterTruncateOversizedPacket(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jumbo.pcap")
+	writer, err := NewWriter(filename, 1<<16, 1000, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(newRawPacket(time.Second, 9000)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != GLOBAL_HEADER_LEN+RECORD_HEADER_LEN+1000 {
+		t.Fatalf("unexpected file size %d", len(content))
+	}
+	if snaplen := binary.LittleEndian.Uint32(content[16:]); snaplen != 1000 {
+		t.Errorf("expected snaplen 1000 in global header, got %d", snaplen)
+	}
+	record := content[GLOBAL_HEADER_LEN:]
+	if inclLen, origLen := binary.LittleEndian.Uint32(record[8:]), binary.LittleEndian.Uint32(record[12:]); inclLen != 1000 || origLen != 9000 {
+		t.Errorf("expected incl_len 1000 and orig_len 9000, got %d and %d", inclLen, origLen)
+	}
+
+}
+
+func TestWriterSnaplenInHeader(t *testing.T) {
+	// 缓冲区小于最大记录时扩大缓冲区，文件头中仍为SNAPLEN
+	filename := filepath.Join(t.TempDir(), "default.pcap")
+	writer, err := NewWriter(filename, 64<<10, 0, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(newRawPacket(time.Second, SNAPLEN)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snaplen := binary.LittleEndian.Uint32(content[16:]); snaplen != SNAPLEN {
+		t.Errorf("expected snaplen %d in global header, got %d", SNAPLEN, snaplen)
+	}
+	if len(content) != GLOBAL_HEADER_LEN+RECORD_HEADER_LEN+SNAPLEN {
+		t.Errorf("packet of snaplen should be written whole, got file size %d", len(content))
+	}
+	if size := getBufferSize(64, 40); size != RECORD_HEADER_LEN+MAX_HEADER_LEN {
+		t.Errorf("buffer should hold a converted packet, got %d", size)
+	}
+}
+
+func TestWriterTruncateConvertedPacket(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "converted.pcap")
+	writer, err := NewWriter(filename, 1<<16, 40, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有RawHeader的包由头部字段转换为以太网帧，长度超过snaplen
+	packet := &datatype.MetaPacket{Timestamp: time.Second, PacketLen: 1500, EthType: layers.EthernetTypeIPv4, Protocol: layers.IPProtocolTCP}
+	packet.TcpData.DataOffset = 5
+	for i := 0; i < 2; i++ {
+		if err := writer.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != GLOBAL_HEADER_LEN+2*(RECORD_HEADER_LEN+40) {
+		t.Fatalf("unexpected file size %d", len(content))
+	}
+	for record := content[GLOBAL_HEADER_LEN:]; len(record) > 0; record = record[RECORD_HEADER_LEN+40:] {
+		if inclLen, origLen := binary.LittleEndian.Uint32(record[8:]), binary.LittleEndian.Uint32(record[12:]); inclLen != 40 || origLen != 1500 {
+			t.Errorf("expected incl_len 40 and orig_len 1500, got %d and %d", inclLen, origLen)
+		}
+	}
+}
+
+func TestWriterLinkType(t *testing.T) {
+	for _, linkType := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeRaw, layers.LinkTypeLinuxSLL} {
+		filename := filepath.Join(t.TempDir(), "linktype.pcap")
+		writer, err := NewWriter(filename, 1<<16, SNAPLEN, linkType, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		reader, err := OpenReader(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.LinkType() != linkType {
+			t.Errorf("expected link type %s, got %s", linkType, reader.LinkType())
+		}
+		reader.Close()
+	}
+}
+
+func TestWriterFlushError(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "error.pcap")
+	writer, err := NewWriter(filename, 4<<10, SNAPLEN, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.fp.Close()
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 后台写入的错误在下次Flush时返回，之后可以重试
+	if err := writer.Flush(); err == nil {
+		t.Error("error of the background flush should be returned")
+	}
+	if err := writer.Flush(); err != nil {
+		t.Errorf("error should be returned only once, got %s", err)
+	}
+	if err := writer.Close(); err == nil {
+		t.Error("Close should return the flush error")
+	}
+}
+
+func TestWriterMonotonicTimestamp(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "reorder.pcap")
+	writer, err := NewWriter(filename, 1<<16, SNAPLEN, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.SetMonotonicTimestamp(0)
+	for _, second := range []time.Duration{3, 1, 2, 4} {
+		writer.Write(newRawPacket(second*time.Second, 64))
+	}
+	if counter := writer.GetStats(); counter.totalReorderedCount != 2 {
+		t.Errorf("expected 2 reordered packets, got %d", counter.totalReorderedCount)
+	}
+	writer.Close()
+
+	records, err := readAll(t, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Duration{3 * time.Second, 3 * time.Second, 3 * time.Second, 4 * time.Second}
+	for i, record := range records {
+		if record.Timestamp != expected[i] {
+			t.Errorf("record %d: expected timestamp %s, got %s", i, expected[i], record.Timestamp)
+		}
+	}
+}
+
+// limitFileSize makes writes beyond size of each file fail with EFBIG after
+// writing partially. The limit is removed by the returned function or at the
+// end of the test.
+func limitFileSize(t *testing.T, size int64) func() {
+	writeFile = func(fp *os.File, b []byte) (int, error) {
+		info, err := fp.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if info.Size()+int64(len(b)) <= size {
+			return fp.Write(b)
+		}
+		n := 0
+		if info.Size() < size {
+			n, _ = fp.Write(b[:size-info.Size()])
+		}
+		return n, syscall.EFBIG
+	}
+	restore := func() { writeFile = (*os.File).Write }
+	t.Cleanup(restore)
+	return restore
+}
+
+func TestWriterPartialRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "partial.pcap")
+	writer, err := NewWriter(filename, 1<<16, SNAPLEN, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第三条记录只能写入一半
+	goodSize := int64(GLOBAL_HEADER_LEN + 2*(RECORD_HEADER_LEN+100))
+	restore := limitFileSize(t, goodSize+50)
+	for i := 1; i <= 3; i++ {
+		writer.Write(newRawPacket(time.Duration(i)*time.Second, 100))
+	}
+	writer.Flush()
+	if err := writer.Flush(); err == nil {
+		t.Fatal("flush should fail")
+	}
+	if size, partial := writer.PartialRecord(); !partial || size != goodSize {
+		t.Fatalf("expected partial record after %d bytes, got %v %d", goodSize, partial, size)
+	}
+
+	// 之后的写入先截掉不完整的记录
+	restore()
+	writer.Write(newRawPacket(4*time.Second, 100))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, partial := writer.PartialRecord(); partial {
+		t.Error("partial record should be truncated before appending")
+	}
+	records, err := readAll(t, filename)
+	if err != nil || len(records) != 3 || records[2].Timestamp != 4*time.Second {
+		t.Errorf("expected records 1, 2 and 4, got %d: %v", len(records), err)
+	}
+
+	if boundary := recordBoundary(make([]byte, GLOBAL_HEADER_LEN-1), true); boundary != 0 {
+		t.Errorf("partial global header should not be kept, got %d", boundary)
+	}
+}
+
+func TestWriterStatsDuringFlush(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "stats.pcap")
+	// 写入变慢，使后台刷盘与统计读取重叠，需配合-race运行
+	writeFile = func(fp *os.File, b []byte) (int, error) {
+		time.Sleep(time.Millisecond)
+		return fp.Write(b)
+	}
+	defer func() { writeFile = (*os.File).Write }()
+
+	writer, err := NewWriter(filename, 1<<12, SNAPLEN, layers.LinkTypeEthernet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written uint64
+	for i := 0; i < 200; i++ {
+		if err := writer.Write(newRawPacket(time.Second, 500)); err != nil {
+			t.Fatal(err)
+		}
+		counter := writer.GetAndResetStats()
+		written += counter.totalWrittenBytes
+		writer.FileSize()
+	}
+	writer.Close()
+	written += writer.GetAndResetStats().totalWrittenBytes
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != uint64(info.Size()) || writer.FileSize() != info.Size() {
+		t.Errorf("expected %d bytes written, counted %d and file size %d", info.Size(), written, writer.FileSize())
+	}
+}
+
+func benchmarkWriterClose(b *testing.B, sync bool) {
+	directory := b.TempDir()
+	packet := newRawPacket(time.Second, 1500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer, err := NewWriter(fmt.Sprintf("%s/%d.pcap", directory, i), 64<<10, SNAPLEN, layers.LinkTypeEthernet, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 1000; j++ {
+			writer.Write(packet)
+		}
+		if sync {
+			writer.Sync()
+		}
+		writer.Close()
+	}
+}
+
+func BenchmarkWriterClose(b *testing.B) {
+	benchmarkWriterClose(b, false)
+}
+
+func BenchmarkWriterSyncAndClose(b *testing.B) {
+	benchmarkWriterClose(b, true)
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/zerodoc"
+)
+
+func TestWriterKeyByFlow(t *testing.T) {
+	w := newTestWorker(t, OptionWriterKeyMode(WRITER_KEY_BY_FLOW))
+	forward := newRawPacket(time.Second, 64)
+	forward.EthType = layers.EthernetTypeIPv4
+	forward.Protocol = layers.IPProtocolTCP
+	forward.IpSrc, forward.IpDst = 0x0a000001, 0x0a000002
+	forward.PortSrc, forward.PortDst = 1234, 80
+	reply := *forward
+	reply.IpSrc, reply.IpDst = forward.IpDst, forward.IpSrc
+	reply.PortSrc, reply.PortDst = forward.PortDst, forward.PortSrc
+	other := *forward
+	other.PortSrc = 1235
+
+	w.writePacket(forward, zerodoc.CLOUD, 1)
+	w.writePacket(&reply, zerodoc.CLOUD, 1)
+	w.writePacket(&other, zerodoc.CLOUD, 1)
+	if len(w.writers[zerodoc.CLOUD]) != 2 || w.FileCreations != 2 {
+		t.Fatalf("expected 2 writers, got %d", len(w.writers[zerodoc.CLOUD]))
+	}
+	flow := newFlowTuple(forward)
+	writer := w.writers[zerodoc.CLOUD][flow.getWriterKey(1)]
+	if writer == nil || writer.packetCount != 2 {
+		t.Fatalf("both directions should be written to the same file")
+	}
+	if writer.flowName != "0a000001-1234-0a000002-80-6" {
+		t.Errorf("unexpected flow name %s", writer.flowName)
+	}
+	if !isTempFilename(writer.tempFilename[len(w.baseDirectory)+len("/1/"):]) {
+		t.Errorf("temp filename %s is not recognized", writer.tempFilename)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*_0a000001-1234-0a000002-80-6_*.pcap")); files != 1 || packets != 2 {
+		t.Errorf("expected both directions in the file of the flow, got %d packets in %d files", packets, files)
+	}
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 2 || packets != 3 {
+		t.Errorf("expected 3 packets in 2 files, got %d packets in %d files", packets, files)
+	}
+}
+
+func TestWriterKeyByPolicy(t *testing.T) {
+	w := newTestWorker(t, OptionWriterKeyMode(WRITER_KEY_BY_POLICY), OptionMaxPacketsPerFile(3))
+	for i := 0; i < 4; i++ {
+		packet := newRawPacket(time.Duration(i+1)*time.Second, 64)
+		packet.TapPort, packet.VtapId = uint32(i), uint16(i)
+		w.writePacket(packet, zerodoc.CLOUD, 1)
+	}
+	w.writePacket(newRawPacket(time.Second, 64), zerodoc.CLOUD, 2)
+	// 第4个包超过包数限制，轮转到新文件
+	if len(w.writers[zerodoc.CLOUD]) != 2 || w.FileCreations != 3 {
+		t.Fatalf("expected 2 writers and 3 creations, got %d and %d", len(w.writers[zerodoc.CLOUD]), w.FileCreations)
+	}
+	w.cleanTimeoutFile(time.Hour)
+	files, _ := filepath.Glob(filepath.Join(w.baseDirectory, "1", "*.pcap"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files of aclGID 1, got %v", files)
+	}
+	for _, file := range files {
+		info, err := ParseFilename(file, nil)
+		if err != nil || info.TapPort != 0 || info.VtapId != 0 {
+			t.Errorf("filename %s should not carry tap port and vtap id: %v", file, err)
+		}
+	}
+}
+
+func TestFlowTupleIPv6Forms(t *testing.T) {
+	w := newTestWorker(t, OptionWriterKeyMode(WRITER_KEY_BY_FLOW))
+	// 同一地址的不同文本形式，以及IPv4映射地址的4字节和16字节形式
+	for _, pair := range [][2]string{{"2001:db8::1", "2001:0DB8:0:0:0:0:0:0001"}, {"::ffff:10.0.0.1", "10.0.0.1"}} {
+		var names []string
+		for _, address := range pair {
+			packet := newRawPacket(time.Second, 64)
+			packet.EthType = layers.EthernetTypeIPv6
+			packet.Ip6Src, packet.Ip6Dst = net.ParseIP(address), net.ParseIP("2001:db8::2")
+			if strings.Contains(address, ".") && !strings.Contains(address, ":") {
+				packet.Ip6Src = packet.Ip6Src.To4()
+			}
+			packet.PortSrc, packet.PortDst = 1234, 80
+			w.writePacket(packet, zerodoc.CLOUD, 1)
+			flow := newFlowTuple(packet)
+			names = append(names, flow.String())
+			if strings.ContainsAny(names[len(names)-1], ":_.") {
+				t.Errorf("flow name %s is not filesystem safe", names[len(names)-1])
+			}
+		}
+		if names[0] != names[1] {
+			t.Errorf("%s and %s should have the same flow name, got %s and %s", pair[0], pair[1], names[0], names[1])
+		}
+	}
+	w.cleanTimeoutFile(time.Hour)
+	if files, packets := countPackets(t, filepath.Join(w.baseDirectory, "1", "*.pcap")); files != 2 || packets != 4 {
+		t.Errorf("expected 4 packets in 2 files, got %d packets in %d files", packets, files)
+	}
+}
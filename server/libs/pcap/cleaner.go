@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -33,10 +34,21 @@ import (
 
 var log = logging.MustGetLogger("pcap")
 
+const (
+	// SUMMARY_SUFFIX is the suffix of the optional JSON summary next to a pcap file
+	SUMMARY_SUFFIX = ".json"
+	// QUARANTINED_SUFFIX is the suffix of temp files kept after write failures,
+	// they're cleaned like finished pcap files
+	QUARANTINED_SUFFIX = ".temp.failed"
+	ENCRYPTED_SUFFIX   = ".enc"
+)
+
 type File struct {
-	location string
-	fileTime time.Time
-	size     int64
+	location  string
+	fileTime  time.Time
+	size      int64
+	directory int // index of the directory in the current clean
+	removed   bool
 }
 
 type Cleaner struct {
@@ -44,19 +56,100 @@ type Cleaner struct {
 	diskFreeSpaceMargin int64
 	cleanPeriod         time.Duration
 	pcapDataRetention   time.Duration
-	baseDirectory       string
 
+	sync.Mutex
+	directories []*directory
+	base        *directory
+}
+
+// maxDirectorySize is shared by all directories, while the free space margin
+// is checked for each directory as they're usually on different volumes
+type directory struct {
+	path     string
 	fileLock *FileLock
+	added    bool // added by AddDirectory, not retired when the base directory changes
+	retired  bool // former base directory, dropped after all its files are removed
 }
 
 func NewCleaner(cleanPeriod time.Duration, maxDirectorySize, diskFreeSpaceMargin int64, baseDirectory string) *Cleaner {
+	base := newDirectory(baseDirectory)
 	return &Cleaner{
 		maxDirectorySize:    maxDirectorySize,
 		diskFreeSpaceMargin: diskFreeSpaceMargin,
 		cleanPeriod:         cleanPeriod,
-		baseDirectory:       baseDirectory,
-		fileLock:            New(baseDirectory),
+		directories:         []*directory{base},
+		base:                base,
+	}
+}
+
+func newDirectory(path string) *directory {
+	path = filepath.Clean(path)
+	return &directory{path: path, fileLock: New(path)}
+}
+
+// getDirectory returns the known directory of path, or adds it if not found
+func (c *Cleaner) getDirectory(path string) *directory {
+	path = filepath.Clean(path)
+	for _, d := range c.directories {
+		if d.path == path {
+			return d
+		}
+	}
+	d := newDirectory(path)
+	c.directories = append(c.directories, d)
+	return d
+}
+
+// AddDirectory adds a directory to clean besides the base directory, e.g. the
+// one pcap files fail over to, empty or known directories are ignored
+func (c *Cleaner) AddDirectory(path string) {
+	if path == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	d := c.getDirectory(path)
+	d.added = true
+	d.retired = false
+}
+
+// SetBaseDirectory switches the base directory to path. The former one is
+// retired unless added by AddDirectory, i.e. it's cleaned until no pcap file
+// is left and then forgotten.
+func (c *Cleaner) SetBaseDirectory(path string) {
+	if path == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	d := c.getDirectory(path)
+	d.retired = false
+	if c.base != d && !c.base.added {
+		c.base.retired = true
+	}
+	c.base = d
+}
+
+// dropRetired forgets the empty directories which are retired
+func (c *Cleaner) dropRetired(empty []*directory) {
+	c.Lock()
+	defer c.Unlock()
+	directories := c.directories[:0]
+	for _, d := range c.directories {
+		dropped := false
+		for _, e := range empty {
+			if d == e && d.retired {
+				dropped = true
+				break
+			}
+		}
+		if dropped {
+			log.Infof("Retired pcap directory %s is empty and no longer cleaned", d.path)
+		} else {
+			directories = append(directories, d)
+		}
 	}
+	c.directories = directories
 }
 
 func (c *Cleaner) UpdatePcapDataRetention(pcapDataRetention time.Duration) {
@@ -67,79 +160,125 @@ func (c *Cleaner) GetPcapDataRetention() time.Duration {
 	return time.Duration(atomic.LoadInt64((*int64)(&c.pcapDataRetention)))
 }
 
+func isPcapFilename(name string) bool {
+	name = strings.TrimSuffix(name, ENCRYPTED_SUFFIX)
+	return strings.HasSuffix(name, ".pcap") || strings.HasSuffix(name, QUARANTINED_SUFFIX)
+}
+
 func (c *Cleaner) work() {
 	var files []File
 	for now := range time.Tick(c.cleanPeriod) {
-		c.fileLock.Lock()
-		files = files[:0]
-		filepath.Walk(c.baseDirectory, func(path string, info os.FileInfo, err error) error {
+		c.Lock()
+		directories := append([]*directory(nil), c.directories...)
+		c.Unlock()
+		files = c.clean(now, directories, files[:0])
+	}
+}
+
+// clean removes the oldest files of all directories over the size and
+// retention limits, files is reused between periods
+func (c *Cleaner) clean(now time.Time, directories []*directory, files []File) []File {
+	for i, d := range directories {
+		d.fileLock.Lock()
+		filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				log.Debugf("Walk directory error: %s", err)
 				// 返回nil，否则Walk()会中止
 				return nil
 			}
 			name := info.Name()
-			if info.IsDir() || !strings.HasSuffix(name, ".pcap") {
+			if info.IsDir() || !isPcapFilename(name) {
 				return nil
 			}
 			files = append(files, File{
-				location: path,
-				fileTime: info.ModTime(),
-				size:     info.Size(),
+				location:  path,
+				fileTime:  info.ModTime(),
+				size:      info.Size(),
+				directory: i,
 			})
 			return nil
 		})
-		// 用结束写入时间倒排
-		sort.Slice(files, func(i, j int) bool { return files[i].fileTime.Sub(files[j].fileTime) > 0 })
-
-		// check delete
-		sumSize := int64(0)
-		nDeleted := 0
-		pcapDataRetention := c.GetPcapDataRetention()
-		firstDeleteIndex, lastDeleteIndex := 0, 0
-		for i, f := range files {
-			sumSize += f.size
-			if sumSize >= c.maxDirectorySize || (pcapDataRetention != 0 && now.Sub(f.fileTime) > pcapDataRetention) {
-				if nDeleted == 0 {
-					firstDeleteIndex = i
-				}
-				lastDeleteIndex = i
-				os.Remove(f.location)
-				nDeleted++
+	}
+	// 用结束写入时间倒排
+	sort.Slice(files, func(i, j int) bool { return files[i].fileTime.Sub(files[j].fileTime) > 0 })
+
+	// check delete
+	sumSize := int64(0)
+	nDeleted := 0
+	pcapDataRetention := c.GetPcapDataRetention()
+	firstDeleteIndex, lastDeleteIndex := 0, 0
+	for i := range files {
+		f := &files[i]
+		sumSize += f.size
+		if sumSize >= c.maxDirectorySize || (pcapDataRetention != 0 && now.Sub(f.fileTime) > pcapDataRetention) {
+			if nDeleted == 0 {
+				firstDeleteIndex = i
 			}
+			lastDeleteIndex = i
+			removeFile(f.location)
+			f.removed = true
+			nDeleted++
 		}
-		if nDeleted > 0 {
-			log.Infof("Pcap total size %d(before deleted), have deleted pcap file count %d, first file name: %s, mod time: %v, size: %d, last file name: %s, mod time: %v, size: %d",
-				sumSize, nDeleted,
-				files[firstDeleteIndex].location, files[firstDeleteIndex].fileTime, files[firstDeleteIndex].size,
-				files[lastDeleteIndex].location, files[lastDeleteIndex].fileTime, files[lastDeleteIndex].size)
-		}
+	}
+	if nDeleted > 0 {
+		log.Infof("Pcap total size %d(before deleted), have deleted pcap file count %d, first file name: %s, mod time: %v, size: %d, last file name: %s, mod time: %v, size: %d",
+			sumSize, nDeleted,
+			files[firstDeleteIndex].location, files[firstDeleteIndex].fileTime, files[firstDeleteIndex].size,
+			files[lastDeleteIndex].location, files[lastDeleteIndex].fileTime, files[lastDeleteIndex].size)
+	}
 
+	for i, d := range directories {
 		fs := syscall.Statfs_t{}
-		err := syscall.Statfs(c.baseDirectory, &fs)
-		if err == nil {
-			nDeletedForFree := 0
-			firstDeleteIndex, lastDeleteIndex = 0, 0
-			free := int64(fs.Bfree) * int64(fs.Bsize)
-			for i := len(files) - nDeleted - 1; i >= 0 && free < c.diskFreeSpaceMargin; i-- {
-				if nDeletedForFree == 0 {
-					firstDeleteIndex = i
-				}
-				lastDeleteIndex = i
-				nDeletedForFree++
-				os.Remove(files[i].location)
-				free += files[i].size
+		if err := syscall.Statfs(d.path, &fs); err != nil {
+			continue
+		}
+		nDeletedForFree := 0
+		firstDeleteIndex, lastDeleteIndex = 0, 0
+		free := int64(fs.Bfree) * int64(fs.Bsize)
+		for j := len(files) - 1; j >= 0 && free < c.diskFreeSpaceMargin; j-- {
+			f := &files[j]
+			if f.removed || f.directory != i {
+				continue
 			}
-			if nDeletedForFree > 0 {
-				log.Infof("Pcap disk free size %d(after deleted), have deleted pcap file count %d, first file name: %s, mod time: %v, size: %d, last file name: %s, mod time: %v, size: %d",
-					free, nDeletedForFree,
-					files[firstDeleteIndex].location, files[firstDeleteIndex].fileTime, files[firstDeleteIndex].size,
-					files[lastDeleteIndex].location, files[lastDeleteIndex].fileTime, files[lastDeleteIndex].size)
+			if nDeletedForFree == 0 {
+				firstDeleteIndex = j
 			}
+			lastDeleteIndex = j
+			nDeletedForFree++
+			removeFile(f.location)
+			f.removed = true
+			free += f.size
+		}
+		if nDeletedForFree > 0 {
+			log.Infof("Pcap disk free size %d(after deleted), have deleted pcap file count %d, first file name: %s, mod time: %v, size: %d, last file name: %s, mod time: %v, size: %d",
+				free, nDeletedForFree,
+				files[firstDeleteIndex].location, files[firstDeleteIndex].fileTime, files[firstDeleteIndex].size,
+				files[lastDeleteIndex].location, files[lastDeleteIndex].fileTime, files[lastDeleteIndex].size)
+		}
+	}
 
+	var empty []*directory
+	for i, d := range directories {
+		d.fileLock.Unlock()
+		n := 0
+		for _, f := range files {
+			if f.directory == i && !f.removed {
+				n++
+			}
+		}
+		if n == 0 {
+			empty = append(empty, d)
 		}
-		c.fileLock.Unlock()
 	}
+	if len(empty) > 0 {
+		c.dropRetired(empty)
+	}
+	return files
+}
+
+func removeFile(location string) {
+	os.Remove(location)
+	os.Remove(location + SUMMARY_SUFFIX)
 }
 
 func (c *Cleaner) Start() {
@@ -0,0 +1,174 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (c) 2023 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanQuarantinedFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	files := []struct {
+		name    string
+		age     time.Duration
+		removed bool
+	}{
+		{"new.pcap", time.Minute, false},
+		{"old.pcap", time.Hour * 2, true},
+		{"old.pcap.temp.failed", time.Hour * 2, true},
+		{"old.pcap.temp.failed.enc", time.Hour * 2, true},
+		{"new.pcap.temp.failed", time.Minute, false},
+		{"old.pcap.temp", time.Hour * 2, false}, // 正在写入的文件不清理
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		os.WriteFile(path, make([]byte, 100), 0644)
+		os.Chtimes(path, now.Add(-f.age), now.Add(-f.age))
+	}
+
+	c := NewCleaner(time.Minute, 1<<30, 0, dir)
+	c.UpdatePcapDataRetention(time.Hour)
+	c.clean(now, c.directories, nil)
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if removed := os.IsNotExist(err); removed != f.removed {
+			t.Errorf("%s removed: %v, expected %v", f.name, removed, f.removed)
+		}
+	}
+}
+
+func TestQuarantinedFilesCountedInSize(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"a.pcap.temp.failed", "b.pcap", "c.pcap"} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, make([]byte, 100), 0644)
+		mtime := now.Add(-time.Duration(i) * time.Minute)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	// 隔离文件占用的空间计入总大小，超出后最旧的文件被删除
+	c := NewCleaner(time.Minute, 250, 0, dir)
+	c.clean(now, c.directories, nil)
+	if _, err := os.Stat(filepath.Join(dir, "c.pcap")); !os.IsNotExist(err) {
+		t.Error("the oldest file should be removed when quarantined files take space")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.pcap.temp.failed")); err != nil {
+		t.Error("the newest quarantined file should be kept")
+	}
+}
+
+func TestCleanAddedDirectory(t *testing.T) {
+	base, failover := t.TempDir(), t.TempDir()
+	now := time.Now()
+	for _, dir := range []string{base, failover} {
+		path := filepath.Join(dir, "old.pcap")
+		os.WriteFile(path, make([]byte, 100), 0644)
+		os.Chtimes(path, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	}
+
+	c := NewCleaner(time.Minute, 1<<30, 0, base)
+	c.AddDirectory(failover)
+	c.AddDirectory(failover + "/")
+	c.AddDirectory("")
+	if len(c.directories) != 2 {
+		t.Fatalf("expected 2 directories, got %d", len(c.directories))
+	}
+	c.UpdatePcapDataRetention(time.Hour)
+	c.clean(now, c.directories, nil)
+	for _, dir := range []string{base, failover} {
+		if _, err := os.Stat(filepath.Join(dir, "old.pcap")); !os.IsNotExist(err) {
+			t.Errorf("expired file in %s is not removed", dir)
+		}
+	}
+}
+
+func TestSharedDirectorySize(t *testing.T) {
+	base, failover := t.TempDir(), t.TempDir()
+	now := time.Now()
+	files := []struct {
+		path    string
+		age     time.Duration
+		removed bool
+	}{
+		{filepath.Join(base, "a.pcap"), time.Minute, false},
+		{filepath.Join(failover, "b.pcap"), 2 * time.Minute, false},
+		{filepath.Join(base, "c.pcap"), 3 * time.Minute, true},
+		{filepath.Join(failover, "d.pcap"), 4 * time.Minute, true},
+	}
+	for _, f := range files {
+		os.WriteFile(f.path, make([]byte, 100), 0644)
+		os.Chtimes(f.path, now.Add(-f.age), now.Add(-f.age))
+	}
+
+	// 所有目录共用一个大小上限，先删除最旧的文件
+	c := NewCleaner(time.Minute, 250, 0, base)
+	c.AddDirectory(failover)
+	c.clean(now, c.directories, nil)
+	for _, f := range files {
+		_, err := os.Stat(f.path)
+		if removed := os.IsNotExist(err); removed != f.removed {
+			t.Errorf("%s removed: %v, expected %v", f.path, removed, f.removed)
+		}
+	}
+}
+
+func TestRetiredDirectory(t *testing.T) {
+	base, next, failover := t.TempDir(), t.TempDir(), t.TempDir()
+	now := time.Now()
+	path := filepath.Join(base, "old.pcap")
+	os.WriteFile(path, make([]byte, 100), 0644)
+	os.Chtimes(path, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+
+	c := NewCleaner(time.Minute, 1<<30, 0, base)
+	c.AddDirectory(failover)
+	c.SetBaseDirectory(next)
+	c.SetBaseDirectory(next + "/")
+	if len(c.directories) != 3 || !c.directories[0].retired {
+		t.Fatalf("the former base directory should be retired")
+	}
+
+	// 旧的基础目录还有文件时继续清理
+	c.clean(now, c.directories, nil)
+	if len(c.directories) != 3 {
+		t.Fatalf("retired directory with files should be kept, got %d directories", len(c.directories))
+	}
+	c.UpdatePcapDataRetention(time.Hour)
+	c.clean(now, c.directories, nil)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expired file in the retired directory is not removed")
+	}
+	c.clean(now, c.directories, nil)
+	if len(c.directories) != 2 {
+		t.Fatalf("empty retired directory should be dropped, got %d directories", len(c.directories))
+	}
+
+	// 通过AddDirectory添加的目录不会被淘汰
+	c.SetBaseDirectory(failover)
+	c.SetBaseDirectory(next)
+	c.clean(now, c.directories, nil)
+	if len(c.directories) != 2 {
+		t.Errorf("added directory should not be retired, got %d directories", len(c.directories))
+	}
+}
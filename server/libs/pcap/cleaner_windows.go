@@ -34,5 +34,11 @@ func (c *Cleaner) GetPcapDataRetention() time.Duration {
 	return 0
 }
 
+func (c *Cleaner) AddDirectory(path string) {
+}
+
+func (c *Cleaner) SetBaseDirectory(path string) {
+}
+
 func (c *Cleaner) Start() {
 }